@@ -1,16 +1,36 @@
 package prometheusmetrics
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rcrowley/go-metrics"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // PrometheusConfig provides a container with config parameters for the
 // Prometheus Exporter
-
+//
+// The With methods must be called before the provider is first flushed.
+// After that, flushing (UpdatePrometheusMetricsOnce, UpdateMetricOnce and
+// everything built on them) is safe from multiple goroutines, and concurrently
+// with the prometheus registry being gathered; flushes run one at a time.
 type PrometheusConfig struct {
 	namespace        string
 	Registry         metrics.Registry // Registry to be exported
@@ -21,8 +41,205 @@ type PrometheusConfig struct {
 	customMetrics    map[string]*CustomCollector
 	histogramBuckets []float64
 	timerBuckets     []float64
+	logger           metrics.Logger
+
+	checkPercentiles       bool
+	skipInvalidPercentiles bool
+
+	sink func([]*dto.MetricFamily) error
+
+	renameReservedSuffixes bool
+
+	extraRegisterers []prometheus.Registerer
+
+	flushSLO         time.Duration
+	flushSLOExceeded prometheus.Counter
+
+	gaugeHistogramBuckets map[string][]float64
+	gaugeHistograms       map[string]prometheus.Histogram
+
+	metricLabels map[string]prometheus.Labels
+
+	snapshotTTL time.Duration
+	snapshots   map[string]snapshotEntry
+
+	filterNaNPercentiles bool
+
+	selfMetricsRegistered bool
+	libraryInfo           bool
+
+	timerExportMode TimerExportMode
+	timerRates      []TimerRate
+
+	flushPanicsMetric bool
+	flushPanics       prometheus.Counter
+
+	lazyRegistration bool
+
+	percentileLeBuckets bool
+
+	subsystemFirst bool
+
+	adaptiveInterval    bool
+	minFlushInterval    time.Duration
+	maxFlushInterval    time.Duration
+	flushBudgetFraction float64
+
+	cumulativeHistograms bool
+	cumulativeBounds     []float64
+	histogramTotals      map[string]histogramTotals
+
+	changeDetection bool
+	valueEvery      int
+	lastNamesHash   uint64
+	skippedTicks    int
+
+	gaugeDigits int
+
+	combinedTimers  bool
+	timerCollectors map[string]*timerCollector
+
+	subsystemAsLabel bool
+
+	onRegistryDiff func(added, removed []string)
+	lastNames      map[string]bool
+
+	typeInHelp  bool
+	metricTypes map[string]string
+
+	flushStats        chan<- FlushStats
+	flushStatsDropped prometheus.Counter
+
+	derivedInfix        string
+	invalidDerivedInfix string
+
+	scrapeCounter bool
+
+	walker     func(fn func(name string, metric interface{}))
+	registries []*registrySource
+
+	apdexTargets map[string]time.Duration
+
+	configInfo    bool
+	samplingRates map[string]int
+	flushes       int
+
+	flushMu sync.Mutex
+
+	countersAsCounters bool
+	globalLabels       prometheus.Labels
+	nameParser         func(name string) (string, prometheus.Labels)
+	maxLabelValues     int
+	labelValues        map[string]map[string]bool
+	nameMapper         func(name string) (string, bool)
+	trimPrefix         string
+	filter             func(name string, metric interface{}) bool
+	owned              map[string][]ownedCollector
+	healthcheckInfo    bool
+	ewmaSuffix         string
+	meterRates         bool
+	stdDev             bool
+	countSum           bool
+	exemplars          func(name string) []prometheus.Exemplar
+	metricBuckets      map[string][]float64
+	timerUnit          time.Duration
+	timerUnitSuffix    bool
+	summaryQuantiles   []float64
+	nativeHistograms   bool
+	nativeSchema       int32
+	created            map[string]time.Time
+	counterValues      map[string]float64
+	descs              map[string]map[string]*prometheus.Desc
+	keys               map[string]map[string]string
+	present            map[string]bool
+	deltaCounters      bool
+	counters           map[string]prometheus.Counter
+	counterLast        map[string]int64
+	counterResets      prometheus.Counter
+	timestamps         bool
+	flushTime          time.Time
+
+	helpProvider         func(name string) string
+	selfTelemetry        bool
+	selfBuckets          []float64
+	lastFlush            prometheus.Gauge
+	flushDuration        prometheus.Histogram
+	translated           prometheus.Counter
+	translationErrors    prometheus.Counter
+	registerErrorHandler func(name string, err error)
+	registerErrors       prometheus.Counter
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	loopMu   sync.Mutex
+	loopDone chan struct{}
+	running  bool
+
+	flatKeys   map[string]string
+	flatKeysMu sync.Mutex
+
+	scanLimit  int
+	scanCursor string
+
+	flushErrors     []error
+	lastFlushErrors []error
+	flushErrorsMu   sync.Mutex
+}
+
+// FlushStats describes a single flush of the go-metrics registry.
+type FlushStats struct {
+	Start    time.Time     // when the flush started
+	Duration time.Duration // how long it took
+	Metrics  int           // number of go-metrics metrics processed
+}
+
+// histogramTotals accumulates a histogram or timer's count, sum and bucket
+// counts across flushes for WithCumulativeHistogram.
+type histogramTotals struct {
+	lastCount uint64
+	count     uint64
+	sum       float64
+	buckets   []float64
+}
+
+// TimerExportMode selects how go-metrics timers are exported.
+type TimerExportMode int
+
+const (
+	// TimerExportDefault exports a timer's one-minute rate as a gauge and its
+	// percentiles as a histogram.
+	TimerExportDefault TimerExportMode = iota
+	// TimerExportSumCount exports only <name>_sum_seconds and <name>_count
+	// counters, enough to compute the average latency with
+	// rate(sum)/rate(count). Both are running totals like those of
+	// WithCumulativeHistogram, so they never decrease even though the sum is
+	// estimated from the timer's sample.
+	TimerExportSumCount
+)
+
+// TimerRate is a rate statistic of a go-metrics Timer.
+type TimerRate int
+
+const (
+	// TimerRate1 is the one-minute rate, exported as <name>_rate1m.
+	TimerRate1 TimerRate = iota
+	// TimerRate5 is the five-minute rate, exported as <name>_rate5m.
+	TimerRate5
+	// TimerRate15 is the fifteen-minute rate, exported as <name>_rate15m.
+	TimerRate15
+	// TimerRateMean is the mean rate, exported as <name>_rate_mean.
+	TimerRateMean
+)
+
+type snapshotEntry struct {
+	snapshot interface{}
+	taken    time.Time
 }
 
+// reservedSuffixes are the series suffixes Prometheus reserves for the
+// components of histograms and summaries.
+var reservedSuffixes = []string{"_bucket", "_count", "_sum"}
+
 // NewPrometheusProvider returns a Provider that produces Prometheus metrics.
 // Namespace and subsystem are applied to all produced metrics.
 func NewPrometheusProvider(r metrics.Registry, namespace string, subsystem string, promRegistry prometheus.Registerer, FlushInterval time.Duration) *PrometheusConfig {
@@ -34,11 +251,84 @@ func NewPrometheusProvider(r metrics.Registry, namespace string, subsystem strin
 		FlushInterval:    FlushInterval,
 		gauges:           make(map[string]prometheus.Gauge),
 		customMetrics:    make(map[string]*CustomCollector),
+		gaugeHistograms:  make(map[string]prometheus.Histogram),
+		snapshots:        make(map[string]snapshotEntry),
+		histogramTotals:  make(map[string]histogramTotals),
+		timerCollectors:  make(map[string]*timerCollector),
+		metricTypes:      make(map[string]string),
+		flatKeys:         make(map[string]string),
+		stop:             make(chan struct{}),
 		histogramBuckets: []float64{0.05, 0.1, 0.25, 0.50, 0.75, 0.9, 0.95, 0.99},
 		timerBuckets:     []float64{0.50, 0.95, 0.99, 0.999},
 	}
 }
 
+// Option configures a provider created by NewPrometheusProviderWithOptions.
+// Options exist for the constructor's arguments and the percentiles; the
+// With methods of PrometheusConfig are the canonical way to configure
+// everything else, and Configure turns any of them into an Option.
+type Option func(*PrometheusConfig)
+
+// NewPrometheusProviderWithOptions returns a Provider that produces Prometheus
+// metrics for r. Without options it registers with
+// prometheus.DefaultRegisterer, uses no namespace or subsystem and flushes
+// every second. Options are applied in order.
+func NewPrometheusProviderWithOptions(r metrics.Registry, opts ...Option) *PrometheusConfig {
+	c := NewPrometheusProvider(r, "", "", prometheus.DefaultRegisterer, time.Second)
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Configure returns an Option that applies a PrometheusConfig method, e.g.
+// Configure((*PrometheusConfig).WithStdDev).
+func Configure(fn func(*PrometheusConfig) *PrometheusConfig) Option {
+	return func(c *PrometheusConfig) { fn(c) }
+}
+
+// WithNamespace sets the namespace applied to all produced metrics.
+func WithNamespace(namespace string) Option {
+	return func(c *PrometheusConfig) { c.namespace = namespace }
+}
+
+// WithSubsystem sets the subsystem applied to all produced metrics.
+func WithSubsystem(subsystem string) Option {
+	return func(c *PrometheusConfig) { c.subsystem = subsystem }
+}
+
+// WithRegisterer sets the Registerer the produced metrics are registered with.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return func(c *PrometheusConfig) { c.promRegistry = r }
+}
+
+// WithFlushInterval sets how often UpdatePrometheusMetrics flushes.
+func WithFlushInterval(d time.Duration) Option {
+	return func(c *PrometheusConfig) { c.FlushInterval = d }
+}
+
+// WithHistogramBuckets sets the percentiles exported for histograms.
+func WithHistogramBuckets(b []float64) Option {
+	return func(c *PrometheusConfig) { c.WithHistogramBuckets(b) }
+}
+
+// WithTimerBuckets sets the percentiles exported for timers.
+func WithTimerBuckets(b []float64) Option {
+	return func(c *PrometheusConfig) { c.WithTimerBuckets(b) }
+}
+
+// WithPercentiles sets the percentiles exported for both histograms and timers.
+func WithPercentiles(p []float64) Option {
+	return func(c *PrometheusConfig) { c.WithPercentiles(p) }
+}
+
+// WithPercentiles sets the percentiles exported for both histograms and
+// timers, like WithHistogramBuckets and WithTimerBuckets together. Use
+// WithMetricBuckets to override them for a single metric.
+func (c *PrometheusConfig) WithPercentiles(p []float64) *PrometheusConfig {
+	return c.WithHistogramBuckets(p).WithTimerBuckets(p)
+}
+
 func (c *PrometheusConfig) WithHistogramBuckets(b []float64) *PrometheusConfig {
 	c.histogramBuckets = b
 	return c
@@ -49,142 +339,2745 @@ func (c *PrometheusConfig) WithTimerBuckets(b []float64) *PrometheusConfig {
 	return c
 }
 
-func (c *PrometheusConfig) flattenKey(key string) string {
-	key = strings.Replace(key, " ", "_", -1)
-	key = strings.Replace(key, ".", "_", -1)
-	key = strings.Replace(key, "-", "_", -1)
-	key = strings.Replace(key, "=", "_", -1)
-	return key
+// WithTimerUnit exports the durations of timers, their sums, means,
+// variances and, with WithPercentileLeBuckets, percentiles, in unit instead
+// of nanoseconds; time.Second follows the Prometheus conventions. With
+// suffix, the histogram and mean series of timers get a unit suffix such as
+// _seconds, unless the timer's name already ends in a unit.
+func (c *PrometheusConfig) WithTimerUnit(unit time.Duration, suffix bool) *PrometheusConfig {
+	c.timerUnit = unit
+	c.timerUnitSuffix = suffix
+	return c
 }
 
-func (c *PrometheusConfig) createKey(name string) string {
-	return fmt.Sprintf("%s_%s_%s", c.namespace, c.subsystem, name)
+// unitNames are the suffixes for the units accepted by WithTimerUnit.
+var unitNames = map[time.Duration]string{
+	time.Nanosecond:  "nanoseconds",
+	time.Microsecond: "microseconds",
+	time.Millisecond: "milliseconds",
+	time.Second:      "seconds",
+	time.Minute:      "minutes",
+	time.Hour:        "hours",
 }
 
-func (c *PrometheusConfig) gaugeFromNameAndValue(name string, val float64) {
-	key := c.createKey(name)
-	g, ok := c.gauges[key]
-	if !ok {
-		g = prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: c.flattenKey(c.namespace),
-			Subsystem: c.flattenKey(c.subsystem),
-			Name:      c.flattenKey(name),
-			Help:      name,
-		})
-		c.promRegistry.Register(g)
-		c.gauges[key] = g
+// scaleDuration converts the duration ns, in nanoseconds, to unit.
+func scaleDuration(ns float64, unit time.Duration) float64 {
+	return ns / float64(unit)
+}
+
+// timerValue converts the timer duration ns, in nanoseconds, to the unit set
+// with WithTimerUnit.
+func (c *PrometheusConfig) timerValue(ns float64) float64 {
+	if c.timerUnit == 0 {
+		return ns
 	}
-	g.Set(val)
+	return scaleDuration(ns, c.timerUnit)
 }
 
-func (c *PrometheusConfig) histogramFromNameAndMetric(name string, goMetric interface{}, buckets []float64) {
-	key := c.createKey(name)
+// timerStat returns stat with the unit suffix of the timer name appended.
+func (c *PrometheusConfig) timerStat(name string, stat string) string {
+	unit, ok := unitNames[c.timerUnit]
+	if !c.timerUnitSuffix || !ok {
+		return stat
+	}
+	flat := c.flattenKey(c.baseName(name))
+	for _, u := range unitNames {
+		if strings.HasSuffix(flat, "_"+u) {
+			return stat
+		}
+	}
+	return stat + "_" + unit
+}
 
-	collector, ok := c.customMetrics[key]
-	if !ok {
-		collector = &CustomCollector{}
-		c.promRegistry.MustRegister(collector)
-		c.customMetrics[key] = collector
+// WithSummaryExport exports histograms and timers as Prometheus summaries
+// with the given quantiles, in place of the const histograms whose buckets
+// are percentiles.
+func (c *PrometheusConfig) WithSummaryExport(quantiles []float64) *PrometheusConfig {
+	c.summaryQuantiles = quantiles
+	return c
+}
+
+// WithNativeHistograms exports go-metrics histograms as Prometheus native
+// histograms built from their sample values, with buckets growing by at most
+// factor. They describe the distribution of the sample, not of every value
+// ever observed. Timers don't expose their sample values and are unaffected.
+func (c *PrometheusConfig) WithNativeHistograms(factor float64) *PrometheusConfig {
+	c.nativeHistograms = true
+	c.nativeSchema = nativeSchema(factor)
+	return c
+}
+
+// nativeSchema returns the native histogram schema with the largest bucket
+// growth factor that doesn't exceed factor.
+func nativeSchema(factor float64) int32 {
+	for schema := int32(-4); schema < 8; schema++ {
+		if math.Pow(2, math.Pow(2, -float64(schema))) <= factor {
+			return schema
+		}
 	}
+	return 8
+}
 
-	var ps []float64
-	var count uint64
-	var sum float64
-	var typeName string
+// nativeBucket returns the index of the native histogram bucket for the
+// positive value v in schema.
+func nativeBucket(v float64, schema int32) int {
+	return int(math.Ceil(math.Log2(v) * math.Pow(2, float64(schema))))
+}
 
-	switch metric := goMetric.(type) {
-	case metrics.Histogram:
-		snapshot := metric.Snapshot()
-		ps = snapshot.Percentiles(buckets)
-		count = uint64(snapshot.Count())
-		sum = float64(snapshot.Sum())
-		typeName = "histogram"
-	case metrics.Timer:
-		snapshot := metric.Snapshot()
-		ps = snapshot.Percentiles(buckets)
-		count = uint64(snapshot.Count())
-		sum = float64(snapshot.Sum())
-		typeName = "timer"
-	default:
-		panic(fmt.Sprintf("unexpected metric type %T", goMetric))
+// WithEWMASuffix appends suffix, such as "_per_second", to the names of the
+// gauges exported for go-metrics EWMAs.
+func (c *PrometheusConfig) WithEWMASuffix(suffix string) *PrometheusConfig {
+	c.ewmaSuffix = suffix
+	return c
+}
+
+// WithMeterRates also exports the 5 and 15 minute rates of go-metrics Meters
+// as <name>_rate5m and <name>_rate15m.
+func (c *PrometheusConfig) WithMeterRates() *PrometheusConfig {
+	c.meterRates = true
+	return c
+}
+
+// WithStdDev also exports the standard deviation of go-metrics Histograms and
+// Timers as <name>_stddev, and the variance of Histograms as <name>_variance
+// (Timers export it regardless).
+func (c *PrometheusConfig) WithStdDev() *PrometheusConfig {
+	c.stdDev = true
+	return c
+}
+
+// WithCountSum also exports the observation count and the sum of the sampled
+// values of go-metrics Histograms and Timers as the gauges <name>_count and
+// <name>_sum, for computing totals and averages without const histograms.
+func (c *PrometheusConfig) WithCountSum() *PrometheusConfig {
+	c.countSum = true
+	return c
+}
+
+// WithExemplars attaches the exemplars returned by fn, e.g. carrying the trace
+// IDs of recent slow requests, to the const histograms exported for the
+// go-metrics Histogram or Timer called name. Each exemplar goes to the first
+// bucket whose upper bound is at least its value. Exemplars are only exposed
+// in the OpenMetrics format.
+func (c *PrometheusConfig) WithExemplars(fn func(name string) []prometheus.Exemplar) *PrometheusConfig {
+	c.exemplars = fn
+	return c
+}
+
+// WithTimestamps exports the const metrics, those of histograms, timers and
+// derived statistics, with the time of the flush that produced them rather
+// than leaving Prometheus to use the scrape time.
+func (c *PrometheusConfig) WithTimestamps() *PrometheusConfig {
+	c.timestamps = true
+	return c
+}
+
+// stamp adds the flush time to m if WithTimestamps is set.
+func (c *PrometheusConfig) stamp(m prometheus.Metric) prometheus.Metric {
+	if !c.timestamps {
+		return m
 	}
+	return prometheus.NewMetricWithTimestamp(c.flushTime, m)
+}
 
-	bucketVals := make(map[float64]uint64)
+// WithHealthcheckErrorInfo exports, next to the 0/1 gauge of every failing
+// go-metrics Healthcheck, a <name>_healthcheck_info gauge with value 1 whose
+// error label holds the check's error message.
+func (c *PrometheusConfig) WithHealthcheckErrorInfo() *PrometheusConfig {
+	c.healthcheckInfo = true
+	return c
+}
 
-	for ii, bucket := range buckets {
-		bucketVals[bucket] = uint64(ps[ii])
+// maxErrorLabelLength bounds the length of the error label of
+// <name>_healthcheck_info.
+const maxErrorLabelLength = 256
+
+// errorLabel returns the error message of err made safe for a label value.
+func errorLabel(err error) string {
+	msg := strings.ToValidUTF8(err.Error(), "?")
+	msg = strings.Join(strings.Fields(msg), " ")
+	if len(msg) > maxErrorLabelLength {
+		msg = strings.ToValidUTF8(msg[:maxErrorLabelLength], "") + "..."
 	}
+	return msg
+}
 
-	desc := prometheus.NewDesc(
-		prometheus.BuildFQName(
-			c.flattenKey(c.namespace),
-			c.flattenKey(c.subsystem),
-			fmt.Sprintf("%s_%s", c.flattenKey(name), typeName),
-		),
-		name,
-		[]string{},
-		map[string]string{},
-	)
+// WithMetricBuckets sets the percentiles exported for the histogram or timer
+// called name, overriding WithHistogramBuckets or WithTimerBuckets.
+func (c *PrometheusConfig) WithMetricBuckets(name string, b []float64) *PrometheusConfig {
+	if c.metricBuckets == nil {
+		c.metricBuckets = make(map[string][]float64)
+	}
+	c.metricBuckets[name] = b
+	return c
+}
 
-	constHistogram, err := prometheus.NewConstHistogram(
-		desc,
-		count,
-		sum,
-		bucketVals,
-	)
+// bucketsFor returns the percentiles exported for the metric name, falling
+// back to defaults.
+func (c *PrometheusConfig) bucketsFor(name string, defaults []float64) []float64 {
+	if b, ok := c.metricBuckets[name]; ok {
+		return b
+	}
+	return defaults
+}
+
+// WithLogger sets the logger used to report problems encountered while
+// exporting metrics. By default nothing is logged.
+func (c *PrometheusConfig) WithLogger(l metrics.Logger) *PrometheusConfig {
+	c.logger = l
+	return c
+}
+
+// WithPercentileConsistencyCheck verifies that the percentiles computed for
+// histograms and timers are monotonically non-decreasing before they are
+// exported. Violations are logged; if skip is true the offending metric is
+// not updated for that flush, otherwise it is exported anyway.
+func (c *PrometheusConfig) WithPercentileConsistencyCheck(skip bool) *PrometheusConfig {
+	c.checkPercentiles = true
+	c.skipInvalidPercentiles = skip
+	return c
+}
 
+// WithSink registers a function that receives the gathered metric families
+// after every flush, so they can be encoded and shipped to a backend other
+// than a Prometheus scraper. The Prometheus registry passed to the provider
+// must also implement prometheus.Gatherer.
+func (c *PrometheusConfig) WithSink(sink func([]*dto.MetricFamily) error) *PrometheusConfig {
+	c.sink = sink
+	return c
+}
+
+// WithReservedSuffixRename appends "_value" to gauges whose name ends in a
+// suffix reserved for histogram and summary series (_bucket, _count, _sum), so
+// they cannot be mistaken for part of a histogram or summary.
+func (c *PrometheusConfig) WithReservedSuffixRename() *PrometheusConfig {
+	c.renameReservedSuffixes = true
+	return c
+}
+
+// AddRegisterer adds another Prometheus registerer that every exported
+// metric is registered with in addition to the provider's own registry. The
+// given labels are attached to all metrics exposed through r, so each target
+// can carry its own label set. It must be called before the first flush.
+func (c *PrometheusConfig) AddRegisterer(r prometheus.Registerer, labels prometheus.Labels) *PrometheusConfig {
+	c.extraRegisterers = append(c.extraRegisterers, prometheus.WrapRegistererWith(labels, r))
+	return c
+}
+
+// register registers collector with the provider's registry and any
+// registerers added with AddRegisterer, returning the first error.
+func (c *PrometheusConfig) register(collector prometheus.Collector) error {
+	err := c.promRegistry.Register(collector)
+	for _, r := range c.extraRegisterers {
+		if rerr := r.Register(collector); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// WithRegisterErrorHandler calls handler with the go-metrics name and the
+// error whenever a collector for that metric can't be registered, for example
+// because its name collides with another collector's.
+func (c *PrometheusConfig) WithRegisterErrorHandler(handler func(name string, err error)) *PrometheusConfig {
+	c.registerErrorHandler = handler
+	return c
+}
+
+// registerMetric registers a collector for the go-metrics metric name. An
+// error is recorded for LastFlushErrors, counted in
+// <namespace>_<subsystem>_register_errors_total and passed to the handler set
+// with WithRegisterErrorHandler.
+func (c *PrometheusConfig) registerMetric(name string, collector prometheus.Collector) {
+	err := c.register(collector)
 	if err == nil {
-		collector.metric = constHistogram
+		return
+	}
+	c.flushErrors = append(c.flushErrors, &MetricError{Name: name, Err: err})
+	if c.registerErrors == nil {
+		c.registerErrors = c.newSelfCounter("register_errors_total", "Number of collectors for go-metrics that could not be registered.")
+	}
+	c.registerErrors.Inc()
+	if c.registerErrorHandler != nil {
+		c.registerErrorHandler(name, err)
 	}
 }
 
-func (c *PrometheusConfig) UpdatePrometheusMetrics() {
-	for _ = range time.Tick(c.FlushInterval) {
-		c.UpdatePrometheusMetricsOnce()
+// exportError logs and records the error exporting the series name.
+func (c *PrometheusConfig) exportError(name string, err error) {
+	c.logf("prometheusmetrics: unable to export %s: %v", name, err)
+	c.flushErrors = append(c.flushErrors, &MetricError{Name: name, Err: err})
+}
+
+// MetricError is the error exporting a single metric.
+type MetricError struct {
+	Name string
+	Err  error
+}
+
+func (e *MetricError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
+}
+
+func (e *MetricError) Unwrap() error {
+	return e.Err
+}
+
+// FlushError is returned by UpdatePrometheusMetricsOnce when metrics could
+// not be exported. Errors holds a MetricError for each of them and, last, the
+// error of the sink, if any.
+type FlushError struct {
+	Errors []error
+}
+
+func (e *FlushError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for ii, err := range e.Errors {
+		msgs[ii] = err.Error()
 	}
+	return fmt.Sprintf("prometheusmetrics: %d errors: %s", len(e.Errors), strings.Join(msgs, "; "))
 }
 
-func (c *PrometheusConfig) UpdatePrometheusMetricsOnce() error {
-	c.Registry.Each(func(name string, i interface{}) {
-		switch metric := i.(type) {
-		case metrics.Counter:
-			c.gaugeFromNameAndValue(name, float64(metric.Count()))
-		case metrics.Gauge:
-			c.gaugeFromNameAndValue(name, float64(metric.Value()))
-		case metrics.GaugeFloat64:
-			c.gaugeFromNameAndValue(name, float64(metric.Value()))
-		case metrics.Histogram:
-			samples := metric.Snapshot().Sample().Values()
-			if len(samples) > 0 {
-				lastSample := samples[len(samples)-1]
-				c.gaugeFromNameAndValue(name, float64(lastSample))
-			}
+func (e *FlushError) Unwrap() []error {
+	return e.Errors
+}
 
-			c.histogramFromNameAndMetric(name, metric, c.histogramBuckets)
-		case metrics.Meter:
-			lastSample := metric.Snapshot().Rate1()
-			c.gaugeFromNameAndValue(name, float64(lastSample))
-		case metrics.Timer:
-			lastSample := metric.Snapshot().Rate1()
-			c.gaugeFromNameAndValue(name, float64(lastSample))
+// LastFlushErrors returns the errors from exporting metrics during the most
+// recent flush.
+func (c *PrometheusConfig) LastFlushErrors() []error {
+	c.flushErrorsMu.Lock()
+	defer c.flushErrorsMu.Unlock()
+	return append([]error(nil), c.lastFlushErrors...)
+}
 
-			c.histogramFromNameAndMetric(name, metric, c.timerBuckets)
-		}
+// unregister unregisters collector from the Registerer and any added with
+// AddRegisterer.
+func (c *PrometheusConfig) unregister(collector prometheus.Collector) {
+	c.promRegistry.Unregister(collector)
+	for _, r := range c.extraRegisterers {
+		r.Unregister(collector)
+	}
+}
+
+// ownedCollector is a collector registered for a go-metrics metric, with the
+// function that drops it from the provider's state.
+type ownedCollector struct {
+	collector prometheus.Collector
+	forget    func()
+}
+
+// own records that collector was registered for the go-metrics metric name.
+func (c *PrometheusConfig) own(name string, collector prometheus.Collector, forget func()) {
+	if c.owned == nil {
+		c.owned = make(map[string][]ownedCollector)
+	}
+	c.owned[name] = append(c.owned[name], ownedCollector{collector, forget})
+}
+
+// unregisterRemoved unregisters the collectors of the go-metrics metrics that
+// are no longer in the registry, so their series stop being exported.
+func (c *PrometheusConfig) unregisterRemoved() {
+	if len(c.owned) == 0 {
+		return
+	}
+	if c.present == nil {
+		c.present = make(map[string]bool, len(c.owned))
+	}
+	present := c.present
+	for name := range present {
+		delete(present, name)
+	}
+	c.each(func(name string, _ interface{}) {
+		present[name] = true
 	})
+	for name, collectors := range c.owned {
+		if present[name] {
+			continue
+		}
+		for _, owned := range collectors {
+			c.unregister(owned.collector)
+			owned.forget()
+		}
+		delete(c.owned, name)
+		delete(c.snapshots, name)
+		delete(c.metricTypes, name)
+		delete(c.descs, name)
+		delete(c.keys, name)
+		base := c.baseName(name)
+		c.flatKeysMu.Lock()
+		delete(c.flatKeys, base)
+		c.flatKeysMu.Unlock()
+	}
+}
+
+// newCustomCollector registers the custom collector for key, exporting the
+// series of the go-metrics metric name described by desc.
+func (c *PrometheusConfig) newCustomCollector(name string, key string, desc *prometheus.Desc) *CustomCollector {
+	collector := &CustomCollector{desc: desc}
+	c.registerMetric(name, collector)
+	c.customMetrics[key] = collector
+	c.own(name, collector, func() { c.forgetCustomMetric(key) })
+	return collector
+}
+
+// forgetCustomMetric drops the state kept for the series of the unregistered
+// custom collector for key.
+func (c *PrometheusConfig) forgetCustomMetric(key string) {
+	delete(c.customMetrics, key)
+	delete(c.histogramTotals, key)
+	delete(c.created, key)
+	delete(c.counterValues, key)
+}
+
+// WithFlushSLO exports a <namespace>_<subsystem>_flush_slo_exceeded_total
+// counter that is incremented whenever a flush takes longer than d.
+func (c *PrometheusConfig) WithFlushSLO(d time.Duration) *PrometheusConfig {
+	c.flushSLO = d
+	return c
+}
+
+// WithGaugeHistogram samples the go-metrics gauge called name on every flush
+// and observes the value into a Prometheus histogram <name>_histogram with the
+// given buckets, building up a distribution of the gauge over time. The gauge
+// itself is still exported as usual.
+func (c *PrometheusConfig) WithGaugeHistogram(name string, buckets []float64) *PrometheusConfig {
+	if c.gaugeHistogramBuckets == nil {
+		c.gaugeHistogramBuckets = make(map[string][]float64)
+	}
+	c.gaugeHistogramBuckets[name] = buckets
+	return c
+}
+
+// WithMetricLabels attaches static labels to individual metrics, keyed by
+// their go-metrics name. Metrics without an entry carry no extra labels.
+func (c *PrometheusConfig) WithMetricLabels(labels map[string]prometheus.Labels) *PrometheusConfig {
+	c.metricLabels = labels
+	return c
+}
+
+var (
+	metricNameRE = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+	labelNameRE  = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+)
+
+// validateLabels checks that labels can be used as const labels, so that a
+// bad label set is reported instead of the metric silently failing to be
+// constructed.
+func validateLabels(labels prometheus.Labels) error {
+	for name, value := range labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("label %s has invalid value %q", name, value)
+		}
+	}
 	return nil
 }
 
-// for collecting prometheus.constHistogram objects
-type CustomCollector struct {
-	prometheus.Collector
+// WithConstLabels attaches labels to every metric exported from the go-metrics
+// registry. Labels set for a metric with WithMetricLabels take precedence.
+func (c *PrometheusConfig) WithConstLabels(labels prometheus.Labels) *PrometheusConfig {
+	c.globalLabels = labels
+	return c
+}
 
-	metric prometheus.Metric
+// WithNameParser splits every go-metrics name into the name of the exported
+// metric and labels for it, so that metrics whose names only differ in the
+// parsed labels are exported as series of the same metric. SemicolonLabels
+// parses names like "http_requests;method=GET;code=200", and LabelRules
+// builds a parser from patterns like "queue.<queue>.depth".
+func (c *PrometheusConfig) WithNameParser(parse func(name string) (string, prometheus.Labels)) *PrometheusConfig {
+	c.nameParser = parse
+	return c
 }
 
-func (c *CustomCollector) Collect(ch chan<- prometheus.Metric) {
-	ch <- c.metric
+// tooManyLabelValues is the value of a parsed label once it has more distinct
+// values than allowed by WithExportDropHighCardinalityLabels.
+const tooManyLabelValues = "__too_many__"
+
+// WithExportDropHighCardinalityLabels guards against labels parsed with
+// WithNameParser exploding the number of series, e.g. when a name contains a
+// raw ID. Once a label has had max distinct values, any new value is exported
+// as __too_many__ and the overflow is logged. Metrics collapsed into the same
+// series that way are reported as registration errors, except for the first.
+func (c *PrometheusConfig) WithExportDropHighCardinalityLabels(max int) *PrometheusConfig {
+	c.maxLabelValues = max
+	c.labelValues = make(map[string]map[string]bool)
+	return c
 }
 
-func (p *CustomCollector) Describe(ch chan<- *prometheus.Desc) {
-	// empty method to fulfill prometheus.Collector interface
+// boundedLabelValue returns the value of the parsed label k, or
+// __too_many__ if it is a new value of a label that already has as many as
+// WithExportDropHighCardinalityLabels allows.
+func (c *PrometheusConfig) boundedLabelValue(k string, v string) string {
+	if c.maxLabelValues <= 0 {
+		return v
+	}
+	seen, ok := c.labelValues[k]
+	if !ok {
+		seen = make(map[string]bool)
+		c.labelValues[k] = seen
+	}
+	if seen[v] {
+		return v
+	}
+	if len(seen) >= c.maxLabelValues {
+		if !seen[tooManyLabelValues] {
+			seen[tooManyLabelValues] = true
+			c.logf("prometheusmetrics: label %s has more than %d values, exporting new ones as %s", k, c.maxLabelValues, tooManyLabelValues)
+		}
+		return tooManyLabelValues
+	}
+	seen[v] = true
+	return v
+}
+
+// SemicolonLabels parses a go-metrics name of the form
+// "<name>;<label>=<value>;...". A name not of that form is returned whole,
+// without labels.
+func SemicolonLabels(name string) (string, prometheus.Labels) {
+	parts := strings.Split(name, ";")
+	if len(parts) == 1 {
+		return name, nil
+	}
+	labels := make(prometheus.Labels, len(parts)-1)
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return name, nil
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return parts[0], labels
+}
+
+// LabelRules returns a name parser for WithNameParser that exports families of
+// go-metrics names as a single metric with labels. Each pattern is a
+// dot-separated name in which segments of the form <label> match any segment
+// and make it the value of label; the other segments make up the exported
+// name. With "queue.<queue>.depth", "queue.orders.depth" is exported as
+// queue_depth{queue="orders"}. Patterns are tried in order, and a name that
+// matches none is returned whole, without labels.
+func LabelRules(patterns ...string) func(name string) (string, prometheus.Labels) {
+	rules := make([]labelRule, len(patterns))
+	for ii, pattern := range patterns {
+		rules[ii] = newLabelRule(pattern)
+	}
+	return func(name string) (string, prometheus.Labels) {
+		segments := strings.Split(name, ".")
+		for _, rule := range rules {
+			if labels, ok := rule.match(segments); ok {
+				return rule.name, labels
+			}
+		}
+		return name, nil
+	}
+}
+
+var labelSegmentRE = regexp.MustCompile(`^<([a-zA-Z_][a-zA-Z0-9_]*)>$`)
+
+// labelRule is a pattern of LabelRules.
+type labelRule struct {
+	segments []string
+	labels   []string // the label of each placeholder segment, "" for literal ones
+	name     string
+}
+
+func newLabelRule(pattern string) labelRule {
+	rule := labelRule{segments: strings.Split(pattern, ".")}
+	rule.labels = make([]string, len(rule.segments))
+	var literals []string
+	for ii, segment := range rule.segments {
+		if m := labelSegmentRE.FindStringSubmatch(segment); m != nil {
+			rule.labels[ii] = m[1]
+			continue
+		}
+		literals = append(literals, segment)
+	}
+	rule.name = strings.Join(literals, ".")
+	return rule
+}
+
+// match returns the labels of the name made of segments if it matches the
+// rule.
+func (r labelRule) match(segments []string) (prometheus.Labels, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	for ii, segment := range segments {
+		if r.labels[ii] == "" && segment != r.segments[ii] {
+			return nil, false
+		}
+	}
+	labels := prometheus.Labels{}
+	for ii, label := range r.labels {
+		if label != "" {
+			labels[label] = segments[ii]
+		}
+	}
+	return labels, true
+}
+
+// WithNameMapper renames go-metrics metrics on export: mapper is given the
+// go-metrics name and returns the name to export it under, or skip to not
+// export it at all. With WithNameParser, labels are parsed from the mapped
+// name.
+func (c *PrometheusConfig) WithNameMapper(mapper func(name string) (promName string, skip bool)) *PrometheusConfig {
+	c.nameMapper = mapper
+	return c
+}
+
+// WithFilter only exports the go-metrics metrics for which keep returns true.
+func (c *PrometheusConfig) WithFilter(keep func(name string, metric interface{}) bool) *PrometheusConfig {
+	c.filter = keep
+	return c
+}
+
+// WithTrimPrefix strips prefix, such as an application prefix that repeats
+// the namespace, from the go-metrics names that start with it before they are
+// exported. It applies after WithNameMapper and before WithNameParser.
+func (c *PrometheusConfig) WithTrimPrefix(prefix string) *PrometheusConfig {
+	c.trimPrefix = prefix
+	return c
+}
+
+// mappedName returns the go-metrics name as renamed by WithNameMapper and
+// WithTrimPrefix.
+func (c *PrometheusConfig) mappedName(name string) string {
+	if c.nameMapper != nil {
+		name, _ = c.nameMapper(name)
+	}
+	return strings.TrimPrefix(name, c.trimPrefix)
+}
+
+// baseName returns the name the go-metrics metric name is exported under,
+// without any labels parsed out of it.
+func (c *PrometheusConfig) baseName(name string) string {
+	name = c.mappedName(name)
+	if c.nameParser == nil {
+		return name
+	}
+	base, _ := c.nameParser(name)
+	return base
+}
+
+// constLabels returns the const labels for the go-metrics metric name.
+func (c *PrometheusConfig) constLabels(name string) prometheus.Labels {
+	source := c.sourceOf(name)
+	if !c.subsystemAsLabel && len(c.globalLabels) == 0 && c.nameParser == nil && source == nil {
+		return c.metricLabels[name]
+	}
+	labels := prometheus.Labels{}
+	for k, v := range c.globalLabels {
+		labels[k] = v
+	}
+	if c.subsystemAsLabel {
+		labels["subsystem"] = c.subsystem
+		if source != nil && source.ownNames {
+			labels["subsystem"] = source.subsystem
+		}
+	}
+	if source != nil {
+		for k, v := range source.labels {
+			labels[k] = v
+		}
+	}
+	if c.nameParser != nil {
+		_, parsed := c.nameParser(c.mappedName(name))
+		for k, v := range parsed {
+			labels[k] = c.boundedLabelValue(k, v)
+		}
+	}
+	for k, v := range c.metricLabels[name] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// WithTimerRates exports the given rates of go-metrics Timers, each as its own
+// series, in place of the default of the one-minute rate under the bare name
+// plus <name>_rate_mean.
+func (c *PrometheusConfig) WithTimerRates(rates ...TimerRate) *PrometheusConfig {
+	c.timerRates = rates
+	return c
+}
+
+// exportTimerRates exports the rates of the timer snapshot selected with
+// WithTimerRates.
+func (c *PrometheusConfig) exportTimerRates(name string, snapshot metrics.Timer) {
+	if c.timerRates == nil {
+		c.gaugeFromNameAndValue(name, snapshot.Rate1())
+		c.constMetricFromNameAndValue(name, "rate_mean", prometheus.GaugeValue, snapshot.RateMean())
+		return
+	}
+	for _, rate := range c.timerRates {
+		switch rate {
+		case TimerRate1:
+			c.constMetricFromNameAndValue(name, "rate1m", prometheus.GaugeValue, snapshot.Rate1())
+		case TimerRate5:
+			c.constMetricFromNameAndValue(name, "rate5m", prometheus.GaugeValue, snapshot.Rate5())
+		case TimerRate15:
+			c.constMetricFromNameAndValue(name, "rate15m", prometheus.GaugeValue, snapshot.Rate15())
+		case TimerRateMean:
+			c.constMetricFromNameAndValue(name, "rate_mean", prometheus.GaugeValue, snapshot.RateMean())
+		}
+	}
+}
+
+// WithTimerExportMode selects how timers are exported.
+func (c *PrometheusConfig) WithTimerExportMode(m TimerExportMode) *PrometheusConfig {
+	c.timerExportMode = m
+	return c
+}
+
+// WithLazyRegistration defers creating and registering the Prometheus
+// collectors for a metric until the first flush in which it has a non-zero
+// value (or, for histograms and timers, a non-zero count), so metrics that
+// are never used are never exported. Healthchecks are always exported, so
+// one that fails from the first flush isn't hidden.
+func (c *PrometheusConfig) WithLazyRegistration() *PrometheusConfig {
+	c.lazyRegistration = true
+	return c
+}
+
+// WithPercentileLeBuckets exports histograms and timers as histograms whose
+// bucket upper bounds are the computed percentile values, each holding the
+// corresponding fraction of the observations. This eases migrating
+// quantile-based dashboards to histogram_quantile, but the buckets are only
+// as accurate as the go-metrics sample and move between flushes, so the
+// series are marked as approximate in their help text.
+func (c *PrometheusConfig) WithPercentileLeBuckets() *PrometheusConfig {
+	c.percentileLeBuckets = true
+	return c
+}
+
+// WithNameOrder controls the order of namespace and subsystem in exported
+// names: namespace_subsystem_name when namespaceFirst is true (the default),
+// subsystem_namespace_name otherwise.
+func (c *PrometheusConfig) WithNameOrder(namespaceFirst bool) *PrometheusConfig {
+	c.subsystemFirst = !namespaceFirst
+	return c
+}
+
+// WithAdaptiveFlushInterval lets UpdatePrometheusMetrics adjust its flush
+// interval within [min, max], starting from FlushInterval. The interval is
+// doubled when a flush takes longer than fraction of it, and halved again
+// once flushes take less than a quarter of that budget.
+func (c *PrometheusConfig) WithAdaptiveFlushInterval(min, max time.Duration, fraction float64) *PrometheusConfig {
+	c.adaptiveInterval = true
+	c.minFlushInterval = min
+	c.maxFlushInterval = max
+	c.flushBudgetFraction = fraction
+	return c
+}
+
+// WithCumulativeHistogram makes histograms and timers export running totals,
+// like a native Prometheus histogram, instead of tracking the go-metrics
+// metric directly. Each flush adds the number of observations made since the
+// previous flush, and their estimated sum (that number times the current
+// mean), to the count and sum. Clearing the go-metrics metric is treated as a
+// reset, so its new observations are still added.
+//
+// The buckets are bounded by the fixed upper bounds given, in the timer unit
+// for timers, or prometheus.DefBuckets if none are. Each flush adds to every
+// bucket the new observations estimated to be at or below its bound, from the
+// share of the metric's sample that is.
+func (c *PrometheusConfig) WithCumulativeHistogram(bounds ...float64) *PrometheusConfig {
+	c.cumulativeHistograms = true
+	c.cumulativeBounds = bounds
+	if len(bounds) == 0 {
+		c.cumulativeBounds = prometheus.DefBuckets
+	}
+	return c
+}
+
+// WithChangeDetection makes the UpdatePrometheusMetrics loop flush only when
+// the set of metric names in the registry has changed since the last flush,
+// or otherwise on every valueEvery-th tick to refresh values. Checking the
+// names is much cheaper than a full flush, so registries whose values rarely
+// change can be polled often while exported values lag by up to valueEvery
+// ticks. Explicit calls to UpdatePrometheusMetricsOnce and the final flush on
+// Stop always flush.
+func (c *PrometheusConfig) WithChangeDetection(valueEvery int) *PrometheusConfig {
+	c.changeDetection = true
+	c.valueEvery = valueEvery
+	return c
+}
+
+// WithGaugeSignificantDigits rounds the values of exported gauges to n
+// significant digits, trading precision for better compression in storage.
+func (c *PrometheusConfig) WithGaugeSignificantDigits(n int) *PrometheusConfig {
+	c.gaugeDigits = n
+	return c
+}
+
+// WithCombinedTimerCollector exports each timer through a single collector
+// that snapshots the timer when Prometheus collects it and emits the series
+// a flush would, plus the mean (<name>_mean), from that one snapshot, so the
+// series are never stale or inconsistent with each other. Flushes only
+// register the collector for new timers. Since nothing is kept between
+// collections, WithSnapshotTTL, WithCumulativeHistogram and
+// TimerExportSumCount don't apply to these timers.
+func (c *PrometheusConfig) WithCombinedTimerCollector() *PrometheusConfig {
+	c.combinedTimers = true
+	return c
+}
+
+// WithSubsystemAsLabel leaves the subsystem out of exported metric names and
+// attaches it as a subsystem="<subsystem>" label instead, so series can be
+// aggregated across subsystems.
+func (c *PrometheusConfig) WithSubsystemAsLabel() *PrometheusConfig {
+	c.subsystemAsLabel = true
+	return c
+}
+
+// OnRegistryDiff registers a callback that is called on every flush with the
+// names of the metrics added to and removed from the registry since the
+// previous flush, each sorted. The first flush reports every metric as added.
+func (c *PrometheusConfig) OnRegistryDiff(f func(added, removed []string)) *PrometheusConfig {
+	c.onRegistryDiff = f
+	return c
+}
+
+// WithTypeInHelp appends the go-metrics type a series was exported from to
+// its help text, e.g. "requests (go-metrics Counter)".
+func (c *PrometheusConfig) WithTypeInHelp() *PrometheusConfig {
+	c.typeInHelp = true
+	return c
+}
+
+// WithHelpProvider uses the text provider returns for a go-metrics name as
+// the help of its series, instead of the name. Returning "" keeps the name.
+func (c *PrometheusConfig) WithHelpProvider(provider func(name string) string) *PrometheusConfig {
+	c.helpProvider = provider
+	return c
+}
+
+// description returns the help text describing the go-metrics metric name.
+func (c *PrometheusConfig) description(name string) string {
+	if c.helpProvider != nil {
+		if help := c.helpProvider(name); help != "" {
+			return help
+		}
+	}
+	return c.baseName(name)
+}
+
+// help returns the help text for a series derived from the go-metrics metric
+// name.
+func (c *PrometheusConfig) help(name string, help string) string {
+	if typeName, ok := c.metricTypes[name]; ok {
+		return fmt.Sprintf("%s (go-metrics %s)", help, typeName)
+	}
+	return help
+}
+
+// goMetricsTypeName returns the name of the go-metrics type of i.
+func goMetricsTypeName(i interface{}) string {
+	switch i.(type) {
+	case metrics.Counter:
+		return "Counter"
+	case metrics.Gauge:
+		return "Gauge"
+	case metrics.GaugeFloat64:
+		return "GaugeFloat64"
+	case metrics.Histogram:
+		return "Histogram"
+	case metrics.Meter:
+		return "Meter"
+	case metrics.Timer:
+		return "Timer"
+	case metrics.EWMA:
+		return "EWMA"
+	case metrics.Healthcheck:
+		return "Healthcheck"
+	}
+	return fmt.Sprintf("%T", i)
+}
+
+// WithFlushStatsChannel sends the FlushStats of every flush to ch. Sends never
+// block: if ch isn't ready the stats are dropped and counted in
+// <namespace>_<subsystem>_flush_stats_dropped_total.
+func (c *PrometheusConfig) WithFlushStatsChannel(ch chan<- FlushStats) *PrometheusConfig {
+	c.flushStats = ch
+	return c
+}
+
+// WithDerivedStatsInfix inserts s between the base name and the statistic in
+// the names of series derived from a metric, e.g. <name>_stats_mean instead
+// of <name>_mean, so they are easy to select together. An s that can't be
+// part of a metric name is ignored, and logged on the first flush.
+func (c *PrometheusConfig) WithDerivedStatsInfix(s string) *PrometheusConfig {
+	infix := c.flattenKey(s)
+	if !metricNameRE.MatchString(infix) {
+		c.invalidDerivedInfix = s
+		return c
+	}
+	c.derivedInfix = infix
+	c.invalidDerivedInfix = ""
+	return c
+}
+
+// derivedName returns the flattened name of the series for the statistic
+// stat derived from the go-metrics metric name.
+func (c *PrometheusConfig) derivedName(name string, stat string) string {
+	if c.derivedInfix != "" {
+		return fmt.Sprintf("%s_%s_%s", c.flattenKey(c.baseName(name)), c.derivedInfix, stat)
+	}
+	return fmt.Sprintf("%s_%s", c.flattenKey(c.baseName(name)), stat)
+}
+
+// WithScrapeCounter exports <namespace>_<subsystem>_scrapes_total, the number
+// of times the metrics have been collected, which helps spot scrapers that
+// stopped or scrape more often than expected. The count includes the scrape
+// reporting it.
+func (c *PrometheusConfig) WithScrapeCounter() *PrometheusConfig {
+	c.scrapeCounter = true
+	return c
+}
+
+// WithRegistryWalker replaces the default iteration over Registry with
+// walker, which must call fn for every metric to export. It lets metrics be
+// discovered outside a single registry's Each, e.g. in nested registries.
+func (c *PrometheusConfig) WithRegistryWalker(walker func(fn func(name string, metric interface{}))) *PrometheusConfig {
+	c.walker = walker
+	return c
+}
+
+// registrySource is a go-metrics registry exported alongside Registry.
+type registrySource struct {
+	registry  metrics.Registry
+	prefix    string
+	ownNames  bool
+	namespace string
+	subsystem string
+	labels    prometheus.Labels
+}
+
+// RegistryOption configures a registry added with WithRegistry.
+type RegistryOption func(*registrySource)
+
+// RegistryNamespace exports the metrics of the registry under namespace and
+// subsystem instead of the provider's.
+func RegistryNamespace(namespace, subsystem string) RegistryOption {
+	return func(s *registrySource) {
+		s.ownNames = true
+		s.namespace = namespace
+		s.subsystem = subsystem
+	}
+}
+
+// RegistryLabels adds labels to every metric of the registry, e.g. one
+// identifying the library it comes from.
+func RegistryLabels(labels prometheus.Labels) RegistryOption {
+	return func(s *registrySource) { s.labels = labels }
+}
+
+// WithRegistry also exports the metrics of r on every flush, with prefix
+// prepended to their names, e.g. to export a library's registry next to the
+// application's. Names must be unique across all exported registries once
+// prefixed.
+func (c *PrometheusConfig) WithRegistry(r metrics.Registry, prefix string, opts ...RegistryOption) *PrometheusConfig {
+	source := &registrySource{registry: r, prefix: prefix}
+	for _, opt := range opts {
+		opt(source)
+	}
+	c.registries = append(c.registries, source)
+	return c
+}
+
+// each calls fn for every metric to export.
+func (c *PrometheusConfig) each(fn func(name string, metric interface{})) {
+	if c.walker != nil {
+		c.walker(fn)
+	} else {
+		c.Registry.Each(fn)
+	}
+	for _, source := range c.registries {
+		source.registry.Each(func(name string, i interface{}) {
+			fn(source.prefix+name, i)
+		})
+	}
+}
+
+// get returns the metric exported under name, or nil.
+func (c *PrometheusConfig) get(name string) interface{} {
+	if i := c.Registry.Get(name); i != nil {
+		return i
+	}
+	for _, source := range c.registries {
+		if i := source.get(name); i != nil {
+			return i
+		}
+	}
+	return nil
+}
+
+// sourceOf returns the registry added with WithRegistry that the metric
+// exported under name comes from, or nil.
+func (c *PrometheusConfig) sourceOf(name string) *registrySource {
+	if len(c.registries) == 0 || c.Registry.Get(name) != nil {
+		return nil
+	}
+	for _, source := range c.registries {
+		if source.get(name) != nil {
+			return source
+		}
+	}
+	return nil
+}
+
+// get returns the metric of the registry exported under name, or nil.
+func (s *registrySource) get(name string) interface{} {
+	if !strings.HasPrefix(name, s.prefix) {
+		return nil
+	}
+	return s.registry.Get(strings.TrimPrefix(name, s.prefix))
+}
+
+// WithApdex exports <name>_apdex, the Apdex score of the timer called name
+// for the target latency: observations up to target count as satisfied, up
+// to four times target as tolerating, and the rest as frustrated. Timers
+// don't expose their sample values, so the distribution is read through
+// Percentiles in steps of 0.1%, which makes the score an approximation.
+func (c *PrometheusConfig) WithApdex(name string, target time.Duration) *PrometheusConfig {
+	if c.apdexTargets == nil {
+		c.apdexTargets = make(map[string]time.Duration)
+	}
+	c.apdexTargets[name] = target
+	return c
+}
+
+// WithSamplingRate processes metrics of metricType, named as in WithTypeInHelp
+// ("Timer", "Histogram", ...), only on every nth flush. Their series keep the
+// last exported value on the flushes in between.
+func (c *PrometheusConfig) WithSamplingRate(metricType string, n int) *PrometheusConfig {
+	if c.samplingRates == nil {
+		c.samplingRates = make(map[string]int)
+	}
+	c.samplingRates[metricType] = n
+	return c
+}
+
+// WithScanLimit processes at most n metrics per flush, resuming after the last
+// processed name, in sorted order, on the next flush. A registry of m metrics
+// then takes m/n flushes to be exported completely, so every series can be
+// that many flush intervals stale.
+func (c *PrometheusConfig) WithScanLimit(n int) *PrometheusConfig {
+	c.scanLimit = n
+	return c
+}
+
+// scan calls fn for the metrics to process on this flush: every metric, or
+// the next scanLimit of them with WithScanLimit.
+func (c *PrometheusConfig) scan(fn func(name string, metric interface{})) {
+	if c.scanLimit <= 0 {
+		c.each(fn)
+		return
+	}
+	all := make(map[string]interface{})
+	var names []string
+	c.each(func(name string, i interface{}) {
+		all[name] = i
+		names = append(names, name)
+	})
+	sort.Strings(names)
+	start := sort.Search(len(names), func(ii int) bool { return names[ii] > c.scanCursor })
+	for ii := 0; ii < c.scanLimit && ii < len(names); ii++ {
+		name := names[(start+ii)%len(names)]
+		fn(name, all[name])
+		c.scanCursor = name
+	}
+}
+
+// sampled reports whether the metric i is processed on the current flush.
+func (c *PrometheusConfig) sampled(i interface{}) bool {
+	n := c.samplingRates[goMetricsTypeName(i)]
+	return n <= 1 || c.flushes%n == 0
+}
+
+// WithCountersAsCounters exports go-metrics Counters as Prometheus counters
+// named <name>_total instead of as gauges, so rate() and increase() work on
+// them. A Counter that is decremented or cleared shows up as a counter reset
+// and restarts the counter's created timestamp.
+func (c *PrometheusConfig) WithCountersAsCounters() *PrometheusConfig {
+	c.countersAsCounters = true
+	return c
+}
+
+// WithDeltaCounters exports go-metrics Counters as Prometheus counters named
+// <name>_total, increased on every flush by how much the Counter grew since
+// the previous one. A Counter that shrank, e.g. because it was cleared, is
+// taken to have been reset to zero: its whole value is added and
+// <namespace>_<subsystem>_counter_resets_total is incremented. The exported
+// counters stay monotonic however the application treats its Counters. It
+// takes precedence over WithCountersAsCounters.
+func (c *PrometheusConfig) WithDeltaCounters() *PrometheusConfig {
+	c.deltaCounters = true
+	return c
+}
+
+// WithSnapshotTTL reuses the snapshot taken of a histogram, meter or timer for
+// up to d before taking a new one. Snapshotting large reservoirs is
+// expensive, so this trades freshness for flush cost: exported values can be
+// up to d (plus the flush interval) stale.
+func (c *PrometheusConfig) WithSnapshotTTL(d time.Duration) *PrometheusConfig {
+	c.snapshotTTL = d
+	return c
+}
+
+// snapshot returns the cached snapshot for name if it is younger than the
+// snapshot TTL, otherwise it calls take and caches the result.
+func (c *PrometheusConfig) snapshot(name string, take func() interface{}) interface{} {
+	if c.snapshotTTL <= 0 {
+		return take()
+	}
+	now := time.Now()
+	if entry, ok := c.snapshots[name]; ok && now.Sub(entry.taken) < c.snapshotTTL {
+		return entry.snapshot
+	}
+	snapshot := take()
+	c.snapshots[name] = snapshotEntry{snapshot: snapshot, taken: now}
+	return snapshot
+}
+
+// WithPercentileNaNFilter replaces NaN percentiles, which some sample
+// implementations produce for nearly empty reservoirs, with the nearest valid
+// lower percentile or the maximum instead of exporting them.
+func (c *PrometheusConfig) WithPercentileNaNFilter() *PrometheusConfig {
+	c.filterNaNPercentiles = true
+	return c
+}
+
+// WithLibraryVersionInfo exports a <namespace>_<subsystem>_library_info gauge
+// with value 1 whose go_metrics and client_golang labels carry the versions of
+// those libraries, as recorded in the binary's build info.
+func (c *PrometheusConfig) WithLibraryVersionInfo() *PrometheusConfig {
+	c.libraryInfo = true
+	return c
+}
+
+// WithConfigInfoMetric exports a <namespace>_<subsystem>_exporter_config_info
+// gauge with value 1 whose flush_interval, namespace and subsystem labels
+// describe the provider's configuration.
+func (c *PrometheusConfig) WithConfigInfoMetric() *PrometheusConfig {
+	c.configInfo = true
+	return c
+}
+
+// WithSelfTelemetry exports metrics about the flushes themselves, under
+// <namespace>_<subsystem>_: last_flush_timestamp_seconds,
+// flush_duration_seconds, metrics_translated_total and
+// translation_errors_total. An old last flush timestamp means the flush loop
+// has stalled.
+func (c *PrometheusConfig) WithSelfTelemetry() *PrometheusConfig {
+	c.selfTelemetry = true
+	return c
+}
+
+// WithSelfHistogramBuckets sets the buckets of the flush_duration_seconds
+// histogram of WithSelfTelemetry, prometheus.DefBuckets by default.
+func (c *PrometheusConfig) WithSelfHistogramBuckets(buckets []float64) *PrometheusConfig {
+	c.selfBuckets = buckets
+	return c
+}
+
+// WithFlushPanicsMetric exports a <namespace>_<subsystem>_flush_panics_total
+// counter of the panics recovered by the UpdatePrometheusMetrics loop.
+func (c *PrometheusConfig) WithFlushPanicsMetric() *PrometheusConfig {
+	c.flushPanicsMetric = true
+	return c
+}
+
+// registerSelfMetrics registers the metrics describing the provider itself
+// that only need to be set up once.
+func (c *PrometheusConfig) registerSelfMetrics() {
+	if c.scrapeCounter {
+		collector := &scrapeCollector{
+			desc: prometheus.NewDesc(c.fqName("scrapes_total"), "Number of times the metrics have been collected.", nil, nil),
+		}
+		if err := c.register(collector); err != nil {
+			c.logf("prometheusmetrics: unable to register scrapes_total: %v", err)
+		}
+	}
+	if c.flushStats != nil {
+		c.flushStatsDropped = c.newSelfCounter("flush_stats_dropped_total", "Number of flush stats dropped because the channel was not ready.")
+	}
+	if c.flushPanicsMetric {
+		c.flushPanics = c.newSelfCounter("flush_panics_total", "Number of panics recovered while flushing metrics.")
+	}
+	if c.libraryInfo {
+		c.registerInfoGauge("library_info", "Versions of the libraries used to export go-metrics to Prometheus.", prometheus.Labels{
+			"go_metrics":    moduleVersion("github.com/rcrowley/go-metrics"),
+			"client_golang": moduleVersion("github.com/prometheus/client_golang"),
+		})
+	}
+	if c.selfTelemetry {
+		c.lastFlush = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: c.fqName("last_flush_timestamp_seconds"),
+			Help: "Unix time of the end of the last flush.",
+		})
+		buckets := c.selfBuckets
+		if buckets == nil {
+			buckets = prometheus.DefBuckets
+		}
+		c.flushDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    c.fqName("flush_duration_seconds"),
+			Help:    "Duration of the flushes of the go-metrics registry.",
+			Buckets: buckets,
+		})
+		for _, collector := range []prometheus.Collector{c.lastFlush, c.flushDuration} {
+			if err := c.register(collector); err != nil {
+				c.logf("prometheusmetrics: unable to register self telemetry: %v", err)
+			}
+		}
+		c.translated = c.newSelfCounter("metrics_translated_total", "Number of go-metrics metrics translated to Prometheus.")
+		c.translationErrors = c.newSelfCounter("translation_errors_total", "Number of errors translating go-metrics metrics to Prometheus.")
+	}
+	if c.configInfo {
+		c.registerInfoGauge("exporter_config_info", "Configuration of the go-metrics to Prometheus exporter.", prometheus.Labels{
+			"flush_interval": c.FlushInterval.String(),
+			"namespace":      c.namespace,
+			"subsystem":      c.subsystem,
+		})
+	}
+}
+
+// registerInfoGauge registers a <namespace>_<subsystem>_<name> gauge with
+// value 1 carrying labels.
+func (c *PrometheusConfig) registerInfoGauge(name, help string, labels prometheus.Labels) {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        c.fqName(name),
+		Help:        help,
+		ConstLabels: labels,
+	})
+	g.Set(1)
+	if err := c.register(g); err != nil {
+		c.logf("prometheusmetrics: unable to register %s: %v", name, err)
+	}
+}
+
+// moduleVersion returns the version of the module at path linked into the
+// binary, or "unknown" if it can't be determined.
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != path {
+			continue
+		}
+		if dep.Replace != nil && dep.Replace.Version != "" {
+			return dep.Replace.Version
+		}
+		if dep.Version != "" {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// newSelfCounter creates and registers a counter describing the provider
+// itself rather than a go-metrics metric.
+func (c *PrometheusConfig) newSelfCounter(name, help string) prometheus.Counter {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: c.fqName(name),
+		Help: help,
+	})
+	if err := c.register(counter); err != nil {
+		c.logf("prometheusmetrics: unable to register %s: %v", name, err)
+	}
+	return counter
+}
+
+func (c *PrometheusConfig) logf(format string, v ...interface{}) {
+	if c.logger != nil {
+		c.logger.Printf(format, v...)
+	}
+}
+
+// flattenKey replaces the characters Prometheus doesn't allow in names. Names
+// are stable across flushes, so the results are cached until the metric is
+// removed from the registry.
+func (c *PrometheusConfig) flattenKey(key string) string {
+	c.flatKeysMu.Lock()
+	defer c.flatKeysMu.Unlock()
+	if flat, ok := c.flatKeys[key]; ok {
+		return flat
+	}
+	flat := strings.Replace(key, " ", "_", -1)
+	flat = strings.Replace(flat, ".", "_", -1)
+	flat = strings.Replace(flat, "-", "_", -1)
+	flat = strings.Replace(flat, "=", "_", -1)
+	c.flatKeys[key] = flat
+	return flat
+}
+
+// gaugeName returns the flattened name used for a gauge, renamed if it would
+// collide with a reserved suffix.
+func (c *PrometheusConfig) gaugeName(name string) string {
+	flat := c.flattenKey(c.baseName(name))
+	if c.renameReservedSuffixes {
+		for _, suffix := range reservedSuffixes {
+			if strings.HasSuffix(flat, suffix) {
+				return flat + "_value"
+			}
+		}
+	}
+	return flat
+}
+
+// NameChanges walks the registry and returns, for every exported go-metrics
+// name that is altered on its way to Prometheus, the original name mapped to
+// the fully-qualified name of its main series. It is meant as an audit aid
+// before rolling out.
+func (c *PrometheusConfig) NameChanges() map[string]string {
+	changes := make(map[string]string)
+	c.each(func(name string, i interface{}) {
+		if c.filter != nil && !c.filter(name, i) {
+			return
+		}
+		if c.nameMapper != nil {
+			if _, skip := c.nameMapper(name); skip {
+				return
+			}
+		}
+		if exported := c.exportedName(name, i); exported != name {
+			changes[name] = c.metricFQName(name, exported)
+		}
+	})
+	return changes
+}
+
+// exportedName returns the name of the main series of the go-metrics metric
+// name, before the namespace and subsystem are added.
+func (c *PrometheusConfig) exportedName(name string, i interface{}) string {
+	if _, ok := i.(metrics.Counter); ok && (c.countersAsCounters || c.deltaCounters) {
+		return c.counterName(name)
+	}
+	return c.gaugeName(name)
+}
+
+// fqName returns the fully-qualified Prometheus name for the already
+// flattened metric name.
+func (c *PrometheusConfig) fqName(name string) string {
+	return c.fqNameIn(c.namespace, c.subsystem, name)
+}
+
+// metricFQName is like fqName for a name derived from the go-metrics metric
+// name, using the namespace and subsystem of the registry it comes from.
+func (c *PrometheusConfig) metricFQName(name string, derived string) string {
+	if source := c.sourceOf(name); source != nil && source.ownNames {
+		return c.fqNameIn(source.namespace, source.subsystem, derived)
+	}
+	return c.fqName(derived)
+}
+
+// fqNameIn returns the fully-qualified Prometheus name for the already
+// flattened metric name in namespace and subsystem.
+func (c *PrometheusConfig) fqNameIn(namespace, subsystem, name string) string {
+	first, second := c.flattenKey(namespace), c.flattenKey(subsystem)
+	if c.subsystemAsLabel {
+		second = ""
+	}
+	if c.subsystemFirst {
+		first, second = second, first
+	}
+	return prometheus.BuildFQName(first, second, name)
+}
+
+func (c *PrometheusConfig) createKey(name string) string {
+	return c.seriesKey(name, "")
+}
+
+// seriesKey returns the key of the series of the go-metrics metric name
+// identified by stat, or of its main series for an empty stat. Keys are built
+// once per metric and dropped with it, so steady-state flushes don't allocate
+// them.
+func (c *PrometheusConfig) seriesKey(name string, stat string) string {
+	keys, ok := c.keys[name]
+	if !ok {
+		if c.keys == nil {
+			c.keys = make(map[string]map[string]string)
+		}
+		keys = make(map[string]string)
+		c.keys[name] = keys
+	}
+	key, ok := keys[stat]
+	if !ok {
+		key = c.namespace + "_" + c.subsystem + "_" + name
+		if stat != "" {
+			key += "_" + stat
+		}
+		keys[stat] = key
+	}
+	return key
+}
+
+func (c *PrometheusConfig) gaugeFromNameAndValue(name string, val float64) {
+	c.suffixedGaugeFromNameAndValue(name, "", val)
+}
+
+// suffixedGaugeFromNameAndValue is like gaugeFromNameAndValue but appends
+// suffix to the name of the gauge.
+func (c *PrometheusConfig) suffixedGaugeFromNameAndValue(name string, suffix string, val float64) {
+	key := c.createKey(name)
+	g, ok := c.gauges[key]
+	if !ok {
+		if c.lazyRegistration && val == 0 {
+			return
+		}
+		g = c.newGauge(name, key, suffix)
+	}
+	if c.gaugeDigits > 0 {
+		val = roundSignificant(val, c.gaugeDigits)
+	}
+	g.Set(val)
+}
+
+// newGauge registers the gauge for key, exporting the go-metrics metric name
+// with suffix appended to its name.
+func (c *PrometheusConfig) newGauge(name string, key string, suffix string) prometheus.Gauge {
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        c.metricFQName(name, c.gaugeName(name)+suffix),
+		Help:        c.help(name, c.description(name)),
+		ConstLabels: c.constLabels(name),
+	})
+	c.registerMetric(name, g)
+	c.gauges[key] = g
+	c.own(name, g, func() { delete(c.gauges, key) })
+	return g
+}
+
+// statHelp holds the help text templates for derived statistics; %s is
+// replaced with the go-metrics name.
+var statHelp = map[string]string{
+	"count":       "Total number of observations of %s.",
+	"sum_seconds": "Sum of observed values of %s in seconds.",
+	"sum":         "Sum of the sampled values of %s.",
+	"rate_mean":   "Mean rate of events of %s per second since it was created.",
+	"rate1m":      "One-minute moving average rate of events of %s per second.",
+	"rate5m":      "Five-minute moving average rate of events of %s per second.",
+	"rate15m":     "Fifteen-minute moving average rate of events of %s per second.",
+	"apdex":       "Apdex score of %s.",
+	"variance":    "Variance of %s in its unit squared.",
+	"stddev":      "Standard deviation of %s.",
+}
+
+// derivedHelp returns the help text for the statistic stat of name.
+func derivedHelp(name string, stat string) string {
+	if template, ok := statHelp[stat]; ok {
+		return fmt.Sprintf(template, name)
+	}
+	return fmt.Sprintf("%s_%s", name, stat)
+}
+
+// constMetricFromNameAndValue exports a derived statistic of the go-metrics
+// metric name as the series <name>_<stat>.
+func (c *PrometheusConfig) constMetricFromNameAndValue(name string, stat string, valueType prometheus.ValueType, val float64) {
+	key := c.seriesKey(name, stat)
+
+	desc := c.statDesc(name, stat)
+	collector, ok := c.customMetrics[key]
+	if !ok {
+		if c.lazyRegistration && val == 0 {
+			return
+		}
+		collector = c.newCustomCollector(name, key, desc)
+	}
+
+	var metric prometheus.Metric
+	var err error
+	if valueType == prometheus.CounterValue {
+		metric, err = prometheus.NewConstMetricWithCreatedTimestamp(desc, valueType, val, c.counterCreated(key, val))
+	} else {
+		metric, err = prometheus.NewConstMetric(desc, valueType, val)
+	}
+	if err != nil {
+		c.exportError(name+"_"+stat, err)
+		return
+	}
+	collector.set(c.stamp(metric))
+}
+
+// statDesc returns the descriptor of the statistic stat of the go-metrics
+// metric name.
+func (c *PrometheusConfig) statDesc(name string, stat string) *prometheus.Desc {
+	return c.cachedDesc(name, stat, func() *prometheus.Desc {
+		return prometheus.NewDesc(
+			c.metricFQName(name, c.derivedName(name, stat)),
+			c.help(name, derivedHelp(c.baseName(name), stat)),
+			[]string{},
+			c.constLabels(name),
+		)
+	})
+}
+
+// counterName returns the flattened name used for a counter, with the _total
+// suffix Prometheus expects of counters.
+func (c *PrometheusConfig) counterName(name string) string {
+	flat := c.flattenKey(c.baseName(name))
+	if strings.HasSuffix(flat, "_total") {
+		return flat
+	}
+	return flat + "_total"
+}
+
+// counterFromNameAndValue exports the go-metrics Counter name as a Prometheus
+// counter.
+func (c *PrometheusConfig) counterFromNameAndValue(name string, val float64) {
+	key := c.seriesKey(name, "total")
+	desc := c.cachedDesc(name, "total", func() *prometheus.Desc {
+		return prometheus.NewDesc(
+			c.metricFQName(name, c.counterName(name)),
+			c.help(name, c.description(name)),
+			[]string{},
+			c.constLabels(name),
+		)
+	})
+
+	collector, ok := c.customMetrics[key]
+	if !ok {
+		if c.lazyRegistration && val == 0 {
+			return
+		}
+		collector = c.newCustomCollector(name, key, desc)
+	}
+
+	metric, err := prometheus.NewConstMetricWithCreatedTimestamp(desc, prometheus.CounterValue, val, c.counterCreated(key, val))
+	if err != nil {
+		c.exportError(c.counterName(name), err)
+		return
+	}
+	collector.set(c.stamp(metric))
+}
+
+// deltaCounterFromNameAndValue adds the growth of the go-metrics Counter name
+// since the previous flush to its Prometheus counter.
+func (c *PrometheusConfig) deltaCounterFromNameAndValue(name string, val int64) {
+	key := c.seriesKey(name, "total")
+	counter, ok := c.counters[key]
+	if !ok {
+		if c.lazyRegistration && val == 0 {
+			return
+		}
+		counter = prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        c.metricFQName(name, c.counterName(name)),
+			Help:        c.help(name, c.description(name)),
+			ConstLabels: c.constLabels(name),
+		})
+		c.registerMetric(name, counter)
+		if c.counters == nil {
+			c.counters = make(map[string]prometheus.Counter)
+			c.counterLast = make(map[string]int64)
+		}
+		c.counters[key] = counter
+		c.own(name, counter, func() {
+			delete(c.counters, key)
+			delete(c.counterLast, key)
+		})
+	}
+	delta := val - c.counterLast[key]
+	if delta < 0 {
+		if c.counterResets == nil {
+			c.counterResets = c.newSelfCounter("counter_resets_total", "Number of times a go-metrics Counter was found to have shrunk since the previous flush.")
+		}
+		c.counterResets.Inc()
+		delta = val
+	}
+	c.counterLast[key] = val
+	if delta > 0 {
+		counter.Add(float64(delta))
+	}
+}
+
+// resettingTimerSnapshot is implemented by the ResettingTimer of go-metrics
+// forks such as go-ethereum's, and by its snapshots.
+type resettingTimerSnapshot interface {
+	Values() []int64
+	Percentiles([]float64) []int64
+	Mean() float64
+}
+
+var resettingTimerSnapshotType = reflect.TypeOf((*resettingTimerSnapshot)(nil)).Elem()
+
+// resettingTimerSnapshotOf takes a snapshot of the ResettingTimer i, which
+// resets it. Its Snapshot method returns a type of the fork, so it is found
+// by reflection.
+func resettingTimerSnapshotOf(i interface{}) (resettingTimerSnapshot, bool) {
+	method := reflect.ValueOf(i).MethodByName("Snapshot")
+	if !method.IsValid() || method.Type().NumIn() != 0 || method.Type().NumOut() != 1 || !method.Type().Out(0).Implements(resettingTimerSnapshotType) {
+		return nil, false
+	}
+	snapshot, ok := method.Call(nil)[0].Interface().(resettingTimerSnapshot)
+	return snapshot, ok && snapshot != nil
+}
+
+// resettingTimerFromNameAndSnapshot exports the values a ResettingTimer
+// recorded since the last flush as a summary with the timer percentiles, and
+// their mean.
+func (c *PrometheusConfig) resettingTimerFromNameAndSnapshot(name string, snapshot resettingTimerSnapshot) {
+	values := snapshot.Values()
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+	buckets := c.bucketsFor(name, c.timerBuckets)
+	quantiles := make(map[float64]float64, len(buckets))
+	for ii, p := range snapshot.Percentiles(buckets) {
+		quantiles[buckets[ii]] = c.timerValue(float64(p))
+	}
+	c.constMetricFromNameAndValue(name, c.timerStat(name, "mean"), prometheus.GaugeValue, c.timerValue(snapshot.Mean()))
+
+	key := c.createKey(name)
+	desc := c.histogramDesc(name, "timer")
+	collector, ok := c.customMetrics[key]
+	if !ok {
+		collector = c.newCustomCollector(name, key, desc)
+	}
+	summary, err := prometheus.NewConstSummary(desc, uint64(len(values)), c.timerValue(sum), quantiles)
+	if err != nil {
+		c.exportError(name, err)
+		return
+	}
+	collector.set(c.stamp(summary))
+}
+
+// gaugeInfoValue returns the strings held by a GaugeInfo of newer go-metrics
+// versions, whose Value method returns a map[string]string of a type of that
+// version, so it is found by reflection.
+func gaugeInfoValue(i interface{}) (map[string]string, bool) {
+	method := reflect.ValueOf(i).MethodByName("Value")
+	if !method.IsValid() || method.Type().NumIn() != 0 || method.Type().NumOut() != 1 {
+		return nil, false
+	}
+	out := method.Type().Out(0)
+	if out.Kind() != reflect.Map || out.Key().Kind() != reflect.String || out.Elem().Kind() != reflect.String {
+		return nil, false
+	}
+	info := make(map[string]string)
+	iter := method.Call(nil)[0].MapRange()
+	for iter.Next() {
+		info[iter.Key().String()] = iter.Value().String()
+	}
+	return info, true
+}
+
+// infoFromNameAndValue exports the strings of the GaugeInfo name as the
+// labels of a <name>_info gauge with value 1.
+func (c *PrometheusConfig) infoFromNameAndValue(name string, info map[string]string) {
+	key := c.seriesKey(name, "info")
+	var labelNames, labelValues []string
+	for k := range info {
+		if !labelNameRE.MatchString(k) || strings.HasPrefix(k, "__") {
+			c.logf("prometheusmetrics: not exporting %s of %s: invalid label name", k, name)
+			continue
+		}
+		labelNames = append(labelNames, k)
+	}
+	sort.Strings(labelNames)
+	for _, k := range labelNames {
+		labelValues = append(labelValues, info[k])
+	}
+	fqName := c.metricFQName(name, c.derivedName(name, "info"))
+	if strings.HasSuffix(c.flattenKey(c.baseName(name)), "_info") {
+		fqName = c.metricFQName(name, c.gaugeName(name))
+	}
+	desc := prometheus.NewDesc(fqName, c.help(name, c.description(name)), labelNames, c.constLabels(name))
+	collector, ok := c.customMetrics[key]
+	if !ok {
+		collector = c.newCustomCollector(name, key, desc)
+	}
+	metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1, labelValues...)
+	if err != nil {
+		c.exportError(name+"_info", err)
+		return
+	}
+	collector.set(c.stamp(metric))
+}
+
+// healthcheckInfoFromNameAndError exports the error of the go-metrics
+// Healthcheck name as the error label of <name>_healthcheck_info, or nothing
+// while the check passes.
+func (c *PrometheusConfig) healthcheckInfoFromNameAndError(name string, err error) {
+	key := c.seriesKey(name, "healthcheck_info")
+	desc := c.cachedDesc(name, "healthcheck_info", func() *prometheus.Desc {
+		return prometheus.NewDesc(
+			c.metricFQName(name, c.derivedName(name, "healthcheck_info")),
+			c.help(name, fmt.Sprintf("Error of the failing healthcheck %s.", c.baseName(name))),
+			[]string{"error"},
+			c.constLabels(name),
+		)
+	})
+	collector, ok := c.customMetrics[key]
+	if !ok {
+		collector = c.newCustomCollector(name, key, desc)
+	}
+	if err == nil {
+		collector.set(nil)
+		return
+	}
+
+	metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1, errorLabel(err))
+	if err != nil {
+		c.exportError(name+"_healthcheck_info", err)
+		return
+	}
+	collector.set(c.stamp(metric))
+}
+
+// roundSignificant rounds val to n significant digits.
+func roundSignificant(val float64, n int) float64 {
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(val, 'g', n, 64), 64)
+	if err != nil {
+		return val
+	}
+	return rounded
+}
+
+func (c *PrometheusConfig) timerCollectorFromNameAndMetric(name string, timer metrics.Timer) {
+	key := c.createKey(name)
+	if _, ok := c.timerCollectors[key]; ok {
+		return
+	}
+	if c.lazyRegistration && timer.Count() == 0 {
+		return
+	}
+	if c.snapshotTTL > 0 || c.cumulativeHistograms || c.timerExportMode == TimerExportSumCount {
+		c.logf("prometheusmetrics: timer %s is collected by a combined collector, which ignores the snapshot TTL, cumulative histograms and the sum/count export mode", name)
+	}
+	collector := &timerCollector{
+		config:        c,
+		name:          name,
+		timer:         timer,
+		buckets:       c.bucketsFor(name, c.timerBuckets),
+		histogramDesc: c.histogramDesc(name, "timer"),
+	}
+	if c.summaryQuantiles != nil {
+		collector.buckets = c.summaryQuantiles
+	}
+	stat := func(stat string, value func(metrics.Timer) float64) {
+		collector.series = append(collector.series, timerSeries{desc: c.statDesc(name, stat), value: value})
+	}
+	if c.timerRates == nil {
+		rate1 := func(s metrics.Timer) float64 { return s.Rate1() }
+		if c.gaugeDigits > 0 {
+			rate1 = func(s metrics.Timer) float64 { return roundSignificant(s.Rate1(), c.gaugeDigits) }
+		}
+		collector.series = append(collector.series, timerSeries{
+			desc: prometheus.NewDesc(
+				c.metricFQName(name, c.gaugeName(name)),
+				c.help(name, c.description(name)),
+				[]string{},
+				c.constLabels(name),
+			),
+			value: rate1,
+		})
+		stat("rate_mean", metrics.Timer.RateMean)
+	}
+	for _, rate := range c.timerRates {
+		switch rate {
+		case TimerRate1:
+			stat("rate1m", metrics.Timer.Rate1)
+		case TimerRate5:
+			stat("rate5m", metrics.Timer.Rate5)
+		case TimerRate15:
+			stat("rate15m", metrics.Timer.Rate15)
+		case TimerRateMean:
+			stat("rate_mean", metrics.Timer.RateMean)
+		}
+	}
+	stat(c.timerStat(name, "mean"), func(s metrics.Timer) float64 { return c.timerValue(s.Mean()) })
+	stat("variance", func(s metrics.Timer) float64 { return c.timerValue(c.timerValue(s.Variance())) })
+	if c.stdDev {
+		stat(c.timerStat(name, "stddev"), func(s metrics.Timer) float64 { return c.timerValue(s.StdDev()) })
+	}
+	if c.countSum {
+		stat("count", func(s metrics.Timer) float64 { return float64(s.Count()) })
+		stat(c.timerStat(name, "sum"), func(s metrics.Timer) float64 { return c.timerValue(float64(s.Sum())) })
+	}
+	if target, ok := c.apdexTargets[name]; ok {
+		collector.apdexDesc = c.statDesc(name, "apdex")
+		collector.apdexTarget = target
+	}
+	c.registerMetric(name, collector)
+	c.timerCollectors[key] = collector
+	c.own(name, collector, func() { delete(c.timerCollectors, key) })
+}
+
+func (c *PrometheusConfig) observeGaugeHistogram(name string, val float64) {
+	buckets, ok := c.gaugeHistogramBuckets[name]
+	if !ok {
+		return
+	}
+	key := c.createKey(name)
+	h, ok := c.gaugeHistograms[key]
+	if !ok {
+		h = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        c.metricFQName(name, c.derivedName(name, "histogram")),
+			Help:        c.help(name, c.description(name)),
+			ConstLabels: c.constLabels(name),
+			Buckets:     buckets,
+		})
+		c.registerMetric(name, h)
+		c.gaugeHistograms[key] = h
+		c.own(name, h, func() { delete(c.gaugeHistograms, key) })
+	}
+	h.Observe(val)
+}
+
+// histogramFromNameAndMetric exports the histogram or timer snapshot of the
+// go-metrics metric name. The snapshot is the one taken for every series of
+// the metric on this flush; it is never snapshotted again.
+func (c *PrometheusConfig) histogramFromNameAndMetric(name string, snapshot interface{}, buckets []float64) {
+	if c.summaryQuantiles != nil {
+		buckets = c.summaryQuantiles
+	}
+	var ps []float64
+	var steps []float64
+	var count uint64
+	var sum float64
+	var mean float64
+	var max float64
+	var typeName string
+
+	switch snapshot := snapshot.(type) {
+	case metrics.Histogram:
+		ps = snapshot.Percentiles(buckets)
+		if c.cumulativeHistograms {
+			steps = snapshot.Percentiles(apdexSteps)
+		}
+		count = uint64(snapshot.Count())
+		sum = float64(snapshot.Sum())
+		mean = snapshot.Mean()
+		max = float64(snapshot.Max())
+		typeName = "histogram"
+	case metrics.Timer:
+		ps = snapshot.Percentiles(buckets)
+		if c.cumulativeHistograms {
+			steps = snapshot.Percentiles(apdexSteps)
+			for ii := range steps {
+				steps[ii] = c.timerValue(steps[ii])
+			}
+		}
+		count = uint64(snapshot.Count())
+		sum = c.timerValue(float64(snapshot.Sum()))
+		mean = c.timerValue(snapshot.Mean())
+		max = c.timerValue(float64(snapshot.Max()))
+		typeName = "timer"
+		for ii := range ps {
+			ps[ii] = c.timerValue(ps[ii])
+		}
+	default:
+		panic(fmt.Sprintf("unexpected metric type %T", snapshot))
+	}
+
+	if c.filterNaNPercentiles {
+		replaceNaNPercentiles(ps, max)
+	}
+
+	if c.checkPercentiles && !percentilesMonotonic(ps) {
+		c.logf("prometheusmetrics: %s %s has non-monotonic percentiles %v for %v", typeName, name, ps, buckets)
+		if c.skipInvalidPercentiles {
+			return
+		}
+	}
+
+	key := c.createKey(name)
+	desc := c.histogramDesc(name, typeName)
+
+	collector, ok := c.customMetrics[key]
+	if !ok {
+		if c.lazyRegistration && count == 0 {
+			return
+		}
+		collector = c.newCustomCollector(name, key, desc)
+	}
+
+	var bucketVals map[float64]uint64
+	if c.cumulativeHistograms {
+		totals := c.accumulateHistogram(key, count, mean, sharesAtOrBelow(steps, c.cumulativeBounds))
+		count, sum = totals.count, totals.sum
+		bucketVals = totals.bucketValues(c.cumulativeBounds)
+	} else {
+		bucketVals = c.bucketValues(buckets, ps, count)
+	}
+
+	if c.summaryQuantiles != nil {
+		quantiles := make(map[float64]float64, len(buckets))
+		for ii, q := range buckets {
+			quantiles[q] = ps[ii]
+		}
+		summary, err := prometheus.NewConstSummary(desc, count, sum, quantiles)
+		if err != nil {
+			c.exportError(name, err)
+			return
+		}
+		collector.set(c.stamp(summary))
+		return
+	}
+
+	constHistogram, err := prometheus.NewConstHistogram(
+		desc,
+		count,
+		sum,
+		bucketVals,
+	)
+
+	if err != nil {
+		c.exportError(name, err)
+		return
+	}
+	if c.exemplars != nil {
+		if exemplars := c.exemplars(name); len(exemplars) > 0 {
+			withExemplars, err := prometheus.NewMetricWithExemplars(constHistogram, exemplars...)
+			if err != nil {
+				c.exportError(name, err)
+				return
+			}
+			constHistogram = withExemplars
+		}
+	}
+	collector.set(c.stamp(constHistogram))
+}
+
+// nativeHistogramFromNameAndMetric exports the sample values of the go-metrics
+// histogram name as a native histogram.
+func (c *PrometheusConfig) nativeHistogramFromNameAndMetric(name string, snapshot metrics.Histogram) {
+	values := snapshot.Sample().Values()
+	key := c.createKey(name)
+	desc := c.histogramDesc(name, "histogram")
+
+	collector, ok := c.customMetrics[key]
+	if !ok {
+		if c.lazyRegistration && len(values) == 0 {
+			return
+		}
+		collector = c.newCustomCollector(name, key, desc)
+	}
+	created := c.createdAt(key)
+
+	positive, negative := make(map[int]int64), make(map[int]int64)
+	var zero uint64
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+		switch {
+		case v > 0:
+			positive[nativeBucket(float64(v), c.nativeSchema)]++
+		case v < 0:
+			negative[nativeBucket(-float64(v), c.nativeSchema)]++
+		default:
+			zero++
+		}
+	}
+
+	histogram, err := prometheus.NewConstNativeHistogram(
+		desc,
+		uint64(len(values)),
+		sum,
+		positive,
+		negative,
+		zero,
+		c.nativeSchema,
+		0,
+		created,
+	)
+	if err != nil {
+		c.exportError(name, err)
+		return
+	}
+	collector.set(c.stamp(histogram))
+}
+
+// createdAt returns the time the series key was first exported.
+func (c *PrometheusConfig) createdAt(key string) time.Time {
+	if c.created == nil {
+		c.created = make(map[string]time.Time)
+	}
+	created, ok := c.created[key]
+	if !ok {
+		created = time.Now()
+		c.created[key] = created
+	}
+	return created
+}
+
+// counterCreated returns the created timestamp of the counter series key
+// with value val. A value lower than the last one exported is a reset, which
+// restarts the series.
+func (c *PrometheusConfig) counterCreated(key string, val float64) time.Time {
+	if c.counterValues == nil {
+		c.counterValues = make(map[string]float64)
+	}
+	if last, ok := c.counterValues[key]; ok && val < last {
+		delete(c.created, key)
+	}
+	c.counterValues[key] = val
+	return c.createdAt(key)
+}
+
+// histogramDesc returns the descriptor of the histogram exported for the
+// go-metrics histogram or timer name.
+func (c *PrometheusConfig) histogramDesc(name string, typeName string) *prometheus.Desc {
+	return c.cachedDesc(name, typeName, func() *prometheus.Desc {
+		help := c.description(name)
+		if c.percentileLeBuckets {
+			help = fmt.Sprintf("%s (approximate: buckets are bounded by percentile values)", help)
+		}
+		stat := typeName
+		if typeName == "timer" {
+			stat = c.timerStat(name, stat)
+		}
+		return prometheus.NewDesc(
+			c.metricFQName(name, c.derivedName(name, stat)),
+			c.help(name, help),
+			[]string{},
+			c.constLabels(name),
+		)
+	})
+}
+
+// cachedDesc returns the descriptor of the series of the go-metrics metric
+// name identified by series, building it with build on first use. Descriptors
+// are dropped with the metric.
+func (c *PrometheusConfig) cachedDesc(name string, series string, build func() *prometheus.Desc) *prometheus.Desc {
+	descs, ok := c.descs[name]
+	if !ok {
+		if c.descs == nil {
+			c.descs = make(map[string]map[string]*prometheus.Desc)
+		}
+		descs = make(map[string]*prometheus.Desc)
+		c.descs[name] = descs
+	}
+	desc, ok := descs[series]
+	if !ok {
+		desc = build()
+		descs[series] = desc
+	}
+	return desc
+}
+
+// bucketValues returns the buckets of the const histogram exported for the
+// percentiles ps computed at buckets.
+func (c *PrometheusConfig) bucketValues(buckets []float64, ps []float64, count uint64) map[float64]uint64 {
+	bucketVals := make(map[float64]uint64)
+	if c.percentileLeBuckets {
+		for ii, bucket := range buckets {
+			if !math.IsNaN(ps[ii]) {
+				bucketVals[ps[ii]] = uint64(bucket * float64(count))
+			}
+		}
+		return bucketVals
+	}
+	for ii, bucket := range buckets {
+		bucketVals[bucket] = uint64(ps[ii])
+	}
+	return bucketVals
+}
+
+// accumulateHistogram adds the observations made since the last flush to the
+// running totals for key and returns the new totals. Each bucket is given
+// its share in shares of the new observations.
+func (c *PrometheusConfig) accumulateHistogram(key string, count uint64, mean float64, shares []float64) histogramTotals {
+	totals := c.histogramTotals[key]
+	delta := count - totals.lastCount
+	if count < totals.lastCount {
+		// The go-metrics metric was cleared, so all it holds is new.
+		delta = count
+	}
+	totals.lastCount = count
+	totals.count += delta
+	totals.sum += float64(delta) * mean
+	if len(totals.buckets) != len(shares) {
+		totals.buckets = make([]float64, len(shares))
+	}
+	for ii, share := range shares {
+		totals.buckets[ii] += float64(delta) * share
+	}
+	c.histogramTotals[key] = totals
+	return totals
+}
+
+// bucketValues returns the accumulated bucket counts, bounded by bounds.
+func (t histogramTotals) bucketValues(bounds []float64) map[float64]uint64 {
+	bucketVals := make(map[float64]uint64, len(bounds))
+	for ii, total := range t.buckets {
+		bucketVals[bounds[ii]] = uint64(total)
+	}
+	return bucketVals
+}
+
+// sharesAtOrBelow returns, for each bound, the share of the sample at or
+// below it, estimated from the sample's ascending percentiles steps.
+func sharesAtOrBelow(steps []float64, bounds []float64) []float64 {
+	shares := make([]float64, len(bounds))
+	for ii, bound := range bounds {
+		below := sort.Search(len(steps), func(jj int) bool { return steps[jj] > bound })
+		shares[ii] = float64(below) / float64(len(steps))
+	}
+	return shares
+}
+
+// apdexSteps are the percentiles the Apdex score is computed from.
+var apdexSteps = func() []float64 {
+	steps := make([]float64, 1000)
+	for ii := range steps {
+		steps[ii] = (float64(ii) + 0.5) / float64(len(steps))
+	}
+	return steps
+}()
+
+// apdex returns the Apdex score of the timer snapshot for the target latency.
+func apdex(snapshot metrics.Timer, target time.Duration) float64 {
+	var satisfied, tolerating int
+	for _, p := range snapshot.Percentiles(apdexSteps) {
+		switch {
+		case p <= float64(target):
+			satisfied++
+		case p <= float64(4*target):
+			tolerating++
+		}
+	}
+	return (float64(satisfied) + float64(tolerating)/2) / float64(len(apdexSteps))
+}
+
+// replaceNaNPercentiles replaces every NaN in ps with the nearest valid lower
+// percentile, or with max if there is none.
+func replaceNaNPercentiles(ps []float64, max float64) {
+	for ii, p := range ps {
+		if !math.IsNaN(p) {
+			continue
+		}
+		ps[ii] = max
+		for jj := ii - 1; jj >= 0; jj-- {
+			if !math.IsNaN(ps[jj]) {
+				ps[ii] = ps[jj]
+				break
+			}
+		}
+	}
+}
+
+// percentilesMonotonic reports whether every percentile is at least as large
+// as the one before it.
+func percentilesMonotonic(ps []float64) bool {
+	for ii := 1; ii < len(ps); ii++ {
+		if ps[ii] < ps[ii-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// UpdatePrometheusMetrics flushes the go-metrics registry every FlushInterval
+// until Stop is called. Only one loop runs at a time: calling it while it is
+// already running returns immediately.
+func (c *PrometheusConfig) UpdatePrometheusMetrics() {
+	c.loopMu.Lock()
+	if c.running {
+		c.loopMu.Unlock()
+		c.logf("prometheusmetrics: UpdatePrometheusMetrics is already running")
+		return
+	}
+	done := make(chan struct{})
+	c.running = true
+	c.loopDone = done
+	c.loopMu.Unlock()
+	defer func() {
+		c.loopMu.Lock()
+		c.running = false
+		c.loopMu.Unlock()
+		close(done)
+	}()
+	if c.adaptiveInterval {
+		c.updatePrometheusMetricsAdaptive()
+		return
+	}
+	ticker := time.NewTicker(c.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			c.flushRecovering(true)
+			return
+		case <-ticker.C:
+			c.flushRecovering(false)
+		}
+	}
+}
+
+func (c *PrometheusConfig) updatePrometheusMetricsAdaptive() {
+	interval := c.FlushInterval
+	for {
+		select {
+		case <-c.stop:
+			c.flushRecovering(true)
+			return
+		case <-time.After(interval):
+		}
+		start := time.Now()
+		c.flushRecovering(false)
+		interval = c.nextFlushInterval(interval, time.Since(start))
+	}
+}
+
+// Stop ends the UpdatePrometheusMetrics loop and waits for it to return. The
+// loop flushes one last time, including to any sink, so values updated since
+// the last tick aren't lost. It is safe to call more than once.
+func (c *PrometheusConfig) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+	c.loopMu.Lock()
+	done := c.loopDone
+	c.loopMu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// IsRunning reports whether the UpdatePrometheusMetrics loop is running.
+func (c *PrometheusConfig) IsRunning() bool {
+	c.loopMu.Lock()
+	defer c.loopMu.Unlock()
+	return c.running
+}
+
+// nextFlushInterval returns the interval to wait before the next flush, given
+// the current interval and how long the last flush took.
+func (c *PrometheusConfig) nextFlushInterval(interval time.Duration, elapsed time.Duration) time.Duration {
+	budget := time.Duration(float64(interval) * c.flushBudgetFraction)
+	switch {
+	case elapsed > budget:
+		interval *= 2
+	case elapsed < budget/4:
+		interval /= 2
+	}
+	if interval < c.minFlushInterval {
+		interval = c.minFlushInterval
+	}
+	if interval > c.maxFlushInterval {
+		interval = c.maxFlushInterval
+	}
+	return interval
+}
+
+// flushRecovering runs a single flush for the UpdatePrometheusMetrics loop,
+// recovering from any panic so that the loop keeps running. The final flush
+// on Stop isn't skipped by WithChangeDetection.
+func (c *PrometheusConfig) flushRecovering(final bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.logf("prometheusmetrics: recovered from panic during flush: %v", r)
+			if c.flushPanics != nil {
+				c.flushPanics.Inc()
+			}
+		}
+	}()
+	if !final && c.changeDetection && !c.registryChanged() {
+		return
+	}
+	if err := c.UpdatePrometheusMetricsOnce(); err != nil {
+		c.logf("prometheusmetrics: flush failed: %v", err)
+	}
+}
+
+// registryChanged reports whether the loop should flush on this tick: either
+// the set of metric names changed since the last flush or valueEvery ticks
+// have passed.
+func (c *PrometheusConfig) registryChanged() bool {
+	var hash uint64
+	c.each(func(name string, _ interface{}) {
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		// summing keeps the hash independent of iteration order
+		hash += h.Sum64()
+	})
+	c.skippedTicks++
+	if hash != c.lastNamesHash || c.skippedTicks >= c.valueEvery {
+		c.lastNamesHash = hash
+		c.skippedTicks = 0
+		return true
+	}
+	return false
+}
+
+func (c *PrometheusConfig) UpdatePrometheusMetricsOnce() error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	start := time.Now()
+	c.flushTime = start
+	if !c.selfMetricsRegistered {
+		c.registerSelfMetrics()
+		c.selfMetricsRegistered = true
+	}
+	if c.invalidDerivedInfix != "" {
+		c.logf("prometheusmetrics: ignoring invalid derived stats infix %q", c.invalidDerivedInfix)
+		c.invalidDerivedInfix = ""
+	}
+	processed := 0
+	c.scan(func(name string, i interface{}) {
+		if !c.sampled(i) {
+			return
+		}
+		processed++
+		c.exportMetric(name, i)
+	})
+	c.unregisterRemoved()
+	c.flushes++
+	errs := c.flushErrors
+	c.flushErrorsMu.Lock()
+	c.lastFlushErrors, c.flushErrors = errs, nil
+	c.flushErrorsMu.Unlock()
+	if c.onRegistryDiff != nil {
+		c.reportRegistryDiff()
+	}
+	elapsed := time.Since(start)
+	if c.selfTelemetry {
+		c.lastFlush.Set(float64(time.Now().UnixNano()) / float64(time.Second))
+		c.flushDuration.Observe(elapsed.Seconds())
+		c.translated.Add(float64(processed))
+		c.translationErrors.Add(float64(len(errs)))
+	}
+	if c.flushSLO > 0 {
+		c.observeFlushSLO(elapsed)
+	}
+	if c.flushStats != nil {
+		c.sendFlushStats(FlushStats{Start: start, Duration: elapsed, Metrics: processed})
+	}
+	var sinkErr error
+	if c.sink != nil {
+		sinkErr = c.flushToSink()
+	}
+	if len(errs) == 0 {
+		return sinkErr
+	}
+	if sinkErr != nil {
+		errs = append(errs, sinkErr)
+	}
+	return &FlushError{Errors: errs}
+}
+
+func (c *PrometheusConfig) reportRegistryDiff() {
+	names := make(map[string]bool)
+	var added, removed []string
+	c.each(func(name string, _ interface{}) {
+		names[name] = true
+		if !c.lastNames[name] {
+			added = append(added, name)
+		}
+	})
+	for name := range c.lastNames {
+		if !names[name] {
+			removed = append(removed, name)
+		}
+	}
+	c.lastNames = names
+	sort.Strings(added)
+	sort.Strings(removed)
+	c.onRegistryDiff(added, removed)
+}
+
+// exportMetric updates the Prometheus metrics for a single go-metrics metric.
+// A panic while reading the metric, for example from a functional gauge, is
+// recovered and logged so the rest of the flush can continue.
+func (c *PrometheusConfig) exportMetric(name string, i interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.logf("prometheusmetrics: recovered from panic exporting %s: %v", name, r)
+			c.flushErrors = append(c.flushErrors, &MetricError{Name: name, Err: fmt.Errorf("panic: %v", r)})
+		}
+	}()
+
+	if c.filter != nil && !c.filter(name, i) {
+		return
+	}
+	if c.nameMapper != nil {
+		if _, skip := c.nameMapper(name); skip {
+			return
+		}
+	}
+	// the labels of a metric that already has collectors were validated
+	// when they were created
+	if _, ok := c.owned[name]; !ok {
+		if err := validateLabels(c.constLabels(name)); err != nil {
+			c.logf("prometheusmetrics: not exporting %s: %v", name, err)
+			c.flushErrors = append(c.flushErrors, &MetricError{Name: name, Err: err})
+			return
+		}
+	}
+	if c.typeInHelp {
+		c.metricTypes[name] = goMetricsTypeName(i)
+	}
+
+	switch metric := i.(type) {
+	case metrics.Counter:
+		if c.deltaCounters {
+			c.deltaCounterFromNameAndValue(name, metric.Count())
+			return
+		}
+		if c.countersAsCounters {
+			c.counterFromNameAndValue(name, float64(metric.Count()))
+			return
+		}
+		c.gaugeFromNameAndValue(name, float64(metric.Count()))
+	case metrics.Gauge:
+		val := float64(metric.Value())
+		c.gaugeFromNameAndValue(name, val)
+		c.observeGaugeHistogram(name, val)
+	case metrics.GaugeFloat64:
+		val := metric.Value()
+		c.gaugeFromNameAndValue(name, val)
+		c.observeGaugeHistogram(name, val)
+	case metrics.Histogram:
+		snapshot := c.snapshot(name, func() interface{} { return metric.Snapshot() }).(metrics.Histogram)
+		samples := snapshot.Sample().Values()
+		if len(samples) > 0 {
+			lastSample := samples[len(samples)-1]
+			c.gaugeFromNameAndValue(name, float64(lastSample))
+		}
+		if c.stdDev {
+			c.constMetricFromNameAndValue(name, "stddev", prometheus.GaugeValue, snapshot.StdDev())
+			c.constMetricFromNameAndValue(name, "variance", prometheus.GaugeValue, snapshot.Variance())
+		}
+		if c.countSum {
+			c.constMetricFromNameAndValue(name, "count", prometheus.GaugeValue, float64(snapshot.Count()))
+			c.constMetricFromNameAndValue(name, "sum", prometheus.GaugeValue, float64(snapshot.Sum()))
+		}
+
+		if c.nativeHistograms {
+			c.nativeHistogramFromNameAndMetric(name, snapshot)
+			return
+		}
+		c.histogramFromNameAndMetric(name, snapshot, c.bucketsFor(name, c.histogramBuckets))
+	case metrics.Meter:
+		// Every meter series must be read from the one snapshot so the rates
+		// are consistent with each other; never read them off the live meter.
+		snapshot := c.snapshot(name, func() interface{} { return metric.Snapshot() }).(metrics.Meter)
+		lastSample := snapshot.Rate1()
+		c.gaugeFromNameAndValue(name, float64(lastSample))
+		// <name>_total clashes with the gauge of a metric already named so,
+		// which registerMetric reports instead of breaking Gather
+		c.counterFromNameAndValue(name, float64(snapshot.Count()))
+		if c.meterRates {
+			c.constMetricFromNameAndValue(name, "rate5m", prometheus.GaugeValue, snapshot.Rate5())
+			c.constMetricFromNameAndValue(name, "rate15m", prometheus.GaugeValue, snapshot.Rate15())
+		}
+	case metrics.Timer:
+		if c.combinedTimers {
+			c.timerCollectorFromNameAndMetric(name, metric)
+			return
+		}
+		snapshot := c.snapshot(name, func() interface{} { return metric.Snapshot() }).(metrics.Timer)
+		if c.timerExportMode == TimerExportSumCount {
+			// the totals are kept under the key of the count series, so they
+			// are dropped with it when the timer is removed
+			key := c.seriesKey(name, "count")
+			if _, ok := c.customMetrics[key]; !ok && c.lazyRegistration && snapshot.Count() == 0 {
+				return
+			}
+			totals := c.accumulateHistogram(key, uint64(snapshot.Count()), scaleDuration(snapshot.Mean(), time.Second), nil)
+			c.constMetricFromNameAndValue(name, "sum_seconds", prometheus.CounterValue, totals.sum)
+			c.constMetricFromNameAndValue(name, "count", prometheus.CounterValue, float64(totals.count))
+			return
+		}
+		c.exportTimerRates(name, snapshot)
+		c.constMetricFromNameAndValue(name, "variance", prometheus.GaugeValue, c.timerValue(c.timerValue(snapshot.Variance())))
+		if c.stdDev {
+			c.constMetricFromNameAndValue(name, c.timerStat(name, "stddev"), prometheus.GaugeValue, c.timerValue(snapshot.StdDev()))
+		}
+		if c.countSum {
+			c.constMetricFromNameAndValue(name, "count", prometheus.GaugeValue, float64(snapshot.Count()))
+			c.constMetricFromNameAndValue(name, c.timerStat(name, "sum"), prometheus.GaugeValue, c.timerValue(float64(snapshot.Sum())))
+		}
+		if target, ok := c.apdexTargets[name]; ok && snapshot.Count() > 0 {
+			c.constMetricFromNameAndValue(name, "apdex", prometheus.GaugeValue, apdex(snapshot, target))
+		}
+
+		c.histogramFromNameAndMetric(name, snapshot, c.bucketsFor(name, c.timerBuckets))
+	case metrics.EWMA:
+		c.suffixedGaugeFromNameAndValue(name, c.ewmaSuffix, metric.Snapshot().Rate())
+	case resettingTimerSnapshot:
+		if snapshot, ok := resettingTimerSnapshotOf(metric); ok {
+			c.resettingTimerFromNameAndSnapshot(name, snapshot)
+		}
+	case metrics.Healthcheck:
+		metric.Check()
+		err := metric.Error()
+		healthy := 0.0
+		if err == nil {
+			healthy = 1
+		}
+		// registered even when failing from the start, as a lazily
+		// registered 0 would hide the failure
+		key := c.createKey(name)
+		g, ok := c.gauges[key]
+		if !ok {
+			g = c.newGauge(name, key, "")
+		}
+		g.Set(healthy)
+		if c.healthcheckInfo {
+			c.healthcheckInfoFromNameAndError(name, err)
+		}
+	default:
+		if info, ok := gaugeInfoValue(metric); ok {
+			c.infoFromNameAndValue(name, info)
+		}
+	}
+}
+
+// UpdateMetricOnce updates the Prometheus metrics for the single go-metrics
+// metric registered under name. The registry is only read with Get, so an
+// unknown name returns an error and never registers anything.
+func (c *PrometheusConfig) UpdateMetricOnce(name string) error {
+	i := c.get(name)
+	if i == nil {
+		return fmt.Errorf("prometheusmetrics: no metric named %q", name)
+	}
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.flushTime = time.Now()
+	c.exportMetric(name, i)
+	return nil
+}
+
+// ScrapeGatherer returns a Gatherer that flushes the go-metrics registry
+// before every Gather of g, so scrapes see values read at scrape time. Serve
+// it with promhttp.HandlerFor instead of, or alongside, running
+// UpdatePrometheusMetrics.
+func (c *PrometheusConfig) ScrapeGatherer(g prometheus.Gatherer) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		if err := c.UpdatePrometheusMetricsOnce(); err != nil {
+			c.logf("prometheusmetrics: flush failed: %v", err)
+		}
+		return g.Gather()
+	})
+}
+
+// Handler returns an http.Handler that serves the metrics of the prometheus
+// registry in the Prometheus exposition format, flushing the go-metrics
+// registry on every scrape like ScrapeGatherer.
+func (c *PrometheusConfig) Handler() http.Handler {
+	gatherer, ok := c.promRegistry.(prometheus.Gatherer)
+	if !ok {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "prometheusmetrics: serving requires a prometheus registry that implements prometheus.Gatherer", http.StatusInternalServerError)
+		})
+	}
+	return promhttp.HandlerFor(c.ScrapeGatherer(gatherer), promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serves Handler at /metrics on addr. It blocks until the
+// server fails.
+func (c *PrometheusConfig) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+func (c *PrometheusConfig) sendFlushStats(stats FlushStats) {
+	select {
+	case c.flushStats <- stats:
+	default:
+		c.flushStatsDropped.Inc()
+	}
+}
+
+func (c *PrometheusConfig) observeFlushSLO(elapsed time.Duration) {
+	if c.flushSLOExceeded == nil {
+		c.flushSLOExceeded = c.newSelfCounter("flush_slo_exceeded_total", "Number of flushes that took longer than the configured SLO.")
+	}
+	if elapsed > c.flushSLO {
+		c.flushSLOExceeded.Inc()
+	}
+}
+
+func (c *PrometheusConfig) flushToSink() error {
+	gatherer, ok := c.promRegistry.(prometheus.Gatherer)
+	if !ok {
+		return errors.New("prometheusmetrics: sink requires a prometheus registry that implements prometheus.Gatherer")
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	return c.sink(families)
+}
+
+// WithPushGateway pushes the metrics to the Pushgateway at url on every
+// flush, replacing those previously pushed under job and the grouping labels.
+// Each push is given at most FlushInterval. It replaces any WithSink.
+func (c *PrometheusConfig) WithPushGateway(url string, job string, grouping map[string]string) *PrometheusConfig {
+	c.sink = func(families []*dto.MetricFamily) error {
+		ctx, cancel := context.WithTimeout(context.Background(), c.FlushInterval)
+		defer cancel()
+		return pushFamilies(ctx, url, job, grouping, families)
+	}
+	return c
+}
+
+// PushToGateway flushes the go-metrics registry and pushes the metrics to the
+// Pushgateway at url, replacing those previously pushed under job and the
+// grouping labels. It is meant for batch jobs that end before they can be
+// scraped. The push is cancelled when ctx is done.
+func (c *PrometheusConfig) PushToGateway(ctx context.Context, url string, job string, grouping map[string]string) error {
+	if err := c.UpdatePrometheusMetricsOnce(); err != nil {
+		c.logf("prometheusmetrics: flush failed: %v", err)
+	}
+	gatherer, ok := c.promRegistry.(prometheus.Gatherer)
+	if !ok {
+		return errors.New("prometheusmetrics: pushing requires a prometheus registry that implements prometheus.Gatherer")
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	return pushFamilies(ctx, url, job, grouping, families)
+}
+
+// pushFamilies pushes families to the Pushgateway at url.
+func pushFamilies(ctx context.Context, url string, job string, grouping map[string]string, families []*dto.MetricFamily) error {
+	pusher := push.New(url, job).Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return families, nil
+	}))
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	return pusher.PushContext(ctx)
+}
+
+// for collecting prometheus.constHistogram objects
+type CustomCollector struct {
+	prometheus.Collector
+
+	desc   *prometheus.Desc
+	mu     sync.RWMutex
+	metric prometheus.Metric
+}
+
+// set replaces the metric the collector reports. It is safe to call while
+// the collector is being collected.
+func (c *CustomCollector) set(metric prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metric = metric
+}
+
+func (c *CustomCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	metric := c.metric
+	c.mu.RUnlock()
+	if metric != nil {
+		ch <- metric
+	}
+}
+
+// Describe sends the descriptor of the series, so the collector is checked
+// on registration and can be unregistered.
+func (p *CustomCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.desc
+}
+
+// timerCollector exports all series of a timer from a single snapshot taken
+// at collection time.
+type timerCollector struct {
+	config        *PrometheusConfig
+	name          string
+	timer         metrics.Timer
+	buckets       []float64
+	series        []timerSeries
+	apdexDesc     *prometheus.Desc
+	apdexTarget   time.Duration
+	histogramDesc *prometheus.Desc
+}
+
+// timerSeries is a gauge a timerCollector computes from the timer snapshot.
+type timerSeries struct {
+	desc  *prometheus.Desc
+	value func(metrics.Timer) float64
+}
+
+func (t *timerCollector) Collect(ch chan<- prometheus.Metric) {
+	c := t.config
+	snapshot := t.timer.Snapshot()
+	now := time.Now()
+	send := func(desc *prometheus.Desc, metric prometheus.Metric, err error) {
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			return
+		}
+		if c.timestamps {
+			metric = prometheus.NewMetricWithTimestamp(now, metric)
+		}
+		ch <- metric
+	}
+
+	for _, series := range t.series {
+		metric, err := prometheus.NewConstMetric(series.desc, prometheus.GaugeValue, series.value(snapshot))
+		send(series.desc, metric, err)
+	}
+	if t.apdexDesc != nil && snapshot.Count() > 0 {
+		metric, err := prometheus.NewConstMetric(t.apdexDesc, prometheus.GaugeValue, apdex(snapshot, t.apdexTarget))
+		send(t.apdexDesc, metric, err)
+	}
+
+	count := uint64(snapshot.Count())
+	sum := c.timerValue(float64(snapshot.Sum()))
+	ps := snapshot.Percentiles(t.buckets)
+	for ii := range ps {
+		ps[ii] = c.timerValue(ps[ii])
+	}
+	if c.filterNaNPercentiles {
+		replaceNaNPercentiles(ps, c.timerValue(float64(snapshot.Max())))
+	}
+	if c.checkPercentiles && !percentilesMonotonic(ps) {
+		c.logf("prometheusmetrics: timer %s has non-monotonic percentiles %v for %v", t.name, ps, t.buckets)
+		if c.skipInvalidPercentiles {
+			return
+		}
+	}
+
+	if c.summaryQuantiles != nil {
+		quantiles := make(map[float64]float64, len(t.buckets))
+		for ii, q := range t.buckets {
+			quantiles[q] = ps[ii]
+		}
+		summary, err := prometheus.NewConstSummary(t.histogramDesc, count, sum, quantiles)
+		send(t.histogramDesc, summary, err)
+		return
+	}
+	histogram, err := prometheus.NewConstHistogram(t.histogramDesc, count, sum, c.bucketValues(t.buckets, ps, count))
+	if err == nil && c.exemplars != nil {
+		if exemplars := c.exemplars(t.name); len(exemplars) > 0 {
+			histogram, err = prometheus.NewMetricWithExemplars(histogram, exemplars...)
+		}
+	}
+	send(t.histogramDesc, histogram, err)
+}
+
+func (t *timerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, series := range t.series {
+		ch <- series.desc
+	}
+	if t.apdexDesc != nil {
+		ch <- t.apdexDesc
+	}
+	ch <- t.histogramDesc
+}
+
+// scrapeCollector counts how many times it is collected.
+type scrapeCollector struct {
+	desc    *prometheus.Desc
+	scrapes uint64
+}
+
+func (s *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	// count this scrape before reporting, so the value it exposes includes it
+	scrapes := atomic.AddUint64(&s.scrapes, 1)
+	ch <- prometheus.MustNewConstMetric(s.desc, prometheus.CounterValue, float64(scrapes))
+}
+
+func (s *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
 }
@@ -1,9 +1,19 @@
 package prometheusmetrics
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rcrowley/go-metrics"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -66,8 +76,8 @@ func TestPrometheusCounterGetUpdated(t *testing.T) {
 	cntr.Inc(13)
 	time.Sleep(5 * time.Second)
 	metrics, _ := prometheusRegistry.Gather()
-	serialized := fmt.Sprint(metrics[0])
-	expected := fmt.Sprintf("name:\"test_subsys_counter\" help:\"counter\" type:GAUGE metric:<gauge:<value:%d > > ", cntr.Count())
+	serialized := gaugeFamilyString(metrics[0])
+	expected := fmt.Sprintf("test_subsys_counter counter GAUGE %v", float64(cntr.Count()))
 	if serialized != expected {
 		t.Fatalf("Go-metrics value and prometheus metrics value do not match")
 	}
@@ -87,8 +97,8 @@ func TestPrometheusGaugeGetUpdated(t *testing.T) {
 	if len(metrics) == 0 {
 		t.Fatalf("prometheus was unable to register the metric")
 	}
-	serialized := fmt.Sprint(metrics[0])
-	expected := fmt.Sprintf("name:\"test_subsys_gauge\" help:\"gauge\" type:GAUGE metric:<gauge:<value:%d > > ", gm.Value())
+	serialized := gaugeFamilyString(metrics[0])
+	expected := fmt.Sprintf("test_subsys_gauge gauge GAUGE %v", float64(gm.Value()))
 	if serialized != expected {
 		t.Fatalf("Go-metrics value and prometheus metrics value do not match")
 	}
@@ -108,8 +118,8 @@ func TestPrometheusMeterGetUpdated(t *testing.T) {
 	if len(metrics) == 0 {
 		t.Fatalf("prometheus was unable to register the metric")
 	}
-	serialized := fmt.Sprint(metrics[0])
-	expected := fmt.Sprintf("name:\"test_subsys_meter\" help:\"meter\" type:GAUGE metric:<gauge:<value:%.16f > > ", gm.Rate1())
+	serialized := gaugeFamilyString(metrics[0])
+	expected := fmt.Sprintf("test_subsys_meter meter GAUGE %v", gm.Rate1())
 	if serialized != expected {
 		t.Fatalf("Go-metrics value and prometheus metrics value do not match")
 	}
@@ -140,10 +150,3031 @@ func TestPrometheusHistogramGetUpdated(t *testing.T) {
 		t.Fatalf("prometheus was unable to register the metric")
 	}
 
-	serialized := fmt.Sprint(metrics[1])
+	histogram := metrics[1].GetMetric()[0].GetHistogram()
+	serialized := fmt.Sprintf("%s %s %s %d %v", metrics[1].GetName(), metrics[1].GetHelp(), metrics[1].GetType(), histogram.GetSampleCount(), histogram.GetSampleSum())
+	for _, bucket := range histogram.GetBucket() {
+		serialized += fmt.Sprintf(" %d@%v", bucket.GetCumulativeCount(), bucket.GetUpperBound())
+	}
 
-	expected := `name:"test_subsys_metric_histogram" help:"metric" type:HISTOGRAM metric:<histogram:<sample_count:100 sample_sum:129 bucket:<cumulative_count:1 upper_bound:0.05 > bucket:<cumulative_count:1 upper_bound:0.1 > bucket:<cumulative_count:1 upper_bound:0.25 > bucket:<cumulative_count:1 upper_bound:0.5 > bucket:<cumulative_count:1 upper_bound:0.75 > bucket:<cumulative_count:1 upper_bound:0.9 > bucket:<cumulative_count:5 upper_bound:0.95 > bucket:<cumulative_count:9 upper_bound:0.99 > > > `
+	expected := `test_subsys_metric_histogram metric HISTOGRAM 100 129 1@0.05 1@0.1 1@0.25 1@0.5 1@0.75 1@0.9 5@0.95 9@0.99`
 	if serialized != expected {
 		t.Fatalf("Go-metrics value and prometheus metrics value for max do not match:\n+ %s\n- %s", serialized, expected)
 	}
 }
+
+// gaugeFamilyString renders the name, help, type and value of a family
+// holding a single gauge.
+func gaugeFamilyString(family *dto.MetricFamily) string {
+	return fmt.Sprintf("%s %s %s %v", family.GetName(), family.GetHelp(), family.GetType(), family.GetMetric()[0].GetGauge().GetValue())
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// nonMonotonicHistogram reports percentiles that decrease, as a buggy sample
+// implementation might.
+type nonMonotonicHistogram struct {
+	metrics.Histogram
+}
+
+func (h nonMonotonicHistogram) Snapshot() metrics.Histogram { return h }
+
+func (h nonMonotonicHistogram) Percentiles(ps []float64) []float64 {
+	values := make([]float64, len(ps))
+	for ii := range ps {
+		values[ii] = float64(len(ps) - ii)
+	}
+	return values
+}
+
+func TestPercentileConsistencyCheck(t *testing.T) {
+	for _, skip := range []bool{true, false} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		logger := &recordingLogger{}
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithLogger(logger).
+			WithPercentileConsistencyCheck(skip)
+		gm := nonMonotonicHistogram{metrics.NewHistogram(metrics.NewUniformSample(1028))}
+		gm.Update(1)
+		metricsRegistry.Register("metric", gm)
+
+		pClient.UpdatePrometheusMetricsOnce()
+
+		if len(logger.lines) != 1 {
+			t.Fatalf("expected the consistency check to log one violation, got %v", logger.lines)
+		}
+		families, _ := prometheusRegistry.Gather()
+		exported := false
+		for _, family := range families {
+			if family.GetName() == "test_subsys_metric_histogram" {
+				exported = true
+			}
+		}
+		if exported == skip {
+			t.Fatalf("histogram exported = %v with skip = %v", exported, skip)
+		}
+	}
+}
+
+func TestSinkReceivesGatheredFamilies(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var received [][]*dto.MetricFamily
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSink(func(families []*dto.MetricFamily) error {
+			received = append(received, families)
+			return nil
+		})
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(3)
+
+	pClient.UpdatePrometheusMetricsOnce()
+	cntr.Inc(4)
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if len(received) != 2 {
+		t.Fatalf("expected the sink to be called once per flush, got %d calls", len(received))
+	}
+	for ii, want := range []float64{3, 7} {
+		families := received[ii]
+		if len(families) != 1 || families[0].GetName() != "test_subsys_counter" {
+			t.Fatalf("sink received unexpected families: %v", families)
+		}
+		if got := families[0].GetMetric()[0].GetGauge().GetValue(); got != want {
+			t.Fatalf("flush %d: sink received %v, expected %v", ii, got, want)
+		}
+	}
+}
+
+func TestSinkErrorIsReturned(t *testing.T) {
+	sinkErr := errors.New("backend unavailable")
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithSink(func([]*dto.MetricFamily) error { return sinkErr })
+	if err := pClient.UpdatePrometheusMetricsOnce(); err != sinkErr {
+		t.Fatalf("expected the sink error to be returned, got %v", err)
+	}
+}
+
+func TestReservedSuffixRename(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithReservedSuffixRename()
+	metricsRegistry.Register("foo_bucket", metrics.NewGauge())
+	metricsRegistry.Register("foo_buckets", metrics.NewGauge())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	names := make(map[string]bool)
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	if !names["test_subsys_foo_bucket_value"] || names["test_subsys_foo_bucket"] {
+		t.Fatalf("expected foo_bucket to be renamed to avoid the reserved suffix, got %v", names)
+	}
+	if !names["test_subsys_foo_buckets"] {
+		t.Fatalf("expected foo_buckets to keep its name, got %v", names)
+	}
+}
+
+func TestAddRegistererAppliesPerRegistererLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	localRegistry := prometheus.NewRegistry()
+	remoteRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		AddRegisterer(localRegistry, prometheus.Labels{"instance": "local"}).
+		AddRegisterer(remoteRegistry, prometheus.Labels{"instance": "remote", "region": "eu-1"})
+	cntr := metrics.NewCounter()
+	metricsRegistry.Register("counter", cntr)
+	cntr.Inc(5)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	for _, tc := range []struct {
+		registry *prometheus.Registry
+		labels   map[string]string
+	}{
+		{prometheusRegistry, map[string]string{}},
+		{localRegistry, map[string]string{"instance": "local"}},
+		{remoteRegistry, map[string]string{"instance": "remote", "region": "eu-1"}},
+	} {
+		families, _ := tc.registry.Gather()
+		if len(families) != 1 || families[0].GetName() != "test_subsys_counter" {
+			t.Fatalf("expected the counter in every registry, got %v", families)
+		}
+		m := families[0].GetMetric()[0]
+		if m.GetGauge().GetValue() != 5 {
+			t.Fatalf("expected value 5, got %v", m.GetGauge().GetValue())
+		}
+		got := make(map[string]string)
+		for _, lp := range m.GetLabel() {
+			got[lp.GetName()] = lp.GetValue()
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.labels) {
+			t.Fatalf("expected labels %v, got %v", tc.labels, got)
+		}
+	}
+}
+
+func TestFlushSLOExceeded(t *testing.T) {
+	for _, tc := range []struct {
+		slo      time.Duration
+		expected float64
+	}{
+		{time.Nanosecond, 2},
+		{time.Hour, 0},
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithFlushSLO(tc.slo)
+		metricsRegistry.Register("slow", metrics.NewFunctionalGauge(func() int64 {
+			time.Sleep(10 * time.Millisecond)
+			return 1
+		}))
+
+		pClient.UpdatePrometheusMetricsOnce()
+		pClient.UpdatePrometheusMetricsOnce()
+
+		families, _ := prometheusRegistry.Gather()
+		found := false
+		for _, family := range families {
+			if family.GetName() == "test_subsys_flush_slo_exceeded_total" {
+				found = true
+				if got := family.GetMetric()[0].GetCounter().GetValue(); got != tc.expected {
+					t.Fatalf("slo %v: expected %v exceeded flushes, got %v", tc.slo, tc.expected, got)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("flush_slo_exceeded_total was not exported")
+		}
+	}
+}
+
+func TestGaugeHistogram(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithGaugeHistogram("queue_depth", []float64{1, 5, 10})
+	gm := metrics.NewGaugeFloat64()
+	metricsRegistry.Register("queue_depth", gm)
+
+	for _, depth := range []float64{0.5, 3, 4, 7, 20} {
+		gm.Update(depth)
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+
+	families, _ := prometheusRegistry.Gather()
+	var histogram *dto.Histogram
+	for _, family := range families {
+		if family.GetName() == "test_subsys_queue_depth_histogram" {
+			histogram = family.GetMetric()[0].GetHistogram()
+		}
+	}
+	if histogram == nil {
+		t.Fatalf("gauge histogram was not exported: %v", families)
+	}
+	if histogram.GetSampleCount() != 5 || histogram.GetSampleSum() != 34.5 {
+		t.Fatalf("unexpected count/sum %d/%v", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	expected := []uint64{1, 3, 4}
+	for ii, bucket := range histogram.GetBucket() {
+		if bucket.GetCumulativeCount() != expected[ii] {
+			t.Fatalf("bucket le=%v: expected %d observations, got %d", bucket.GetUpperBound(), expected[ii], bucket.GetCumulativeCount())
+		}
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMetricLabels(map[string]prometheus.Labels{
+			"requests": {"handler": "api"},
+			"latency":  {"handler": "web", "tier": "frontend"},
+		})
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	hist := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	hist.Update(1)
+	metricsRegistry.Register("latency", hist)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]string{
+		"test_subsys_requests":          "map[handler:api]",
+		"test_subsys_latency":           "map[handler:web tier:frontend]",
+		"test_subsys_latency_histogram": "map[handler:web tier:frontend]",
+	}
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != len(expected) {
+		t.Fatalf("expected %d families, got %v", len(expected), families)
+	}
+	for _, family := range families {
+		labels := make(map[string]string)
+		for _, lp := range family.GetMetric()[0].GetLabel() {
+			labels[lp.GetName()] = lp.GetValue()
+		}
+		if got := fmt.Sprint(labels); got != expected[family.GetName()] {
+			t.Fatalf("%s: expected labels %s, got %s", family.GetName(), expected[family.GetName()], got)
+		}
+	}
+}
+
+func TestPanickingMetricDoesNotAbortFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	logger := &recordingLogger{}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLogger(logger)
+	metricsRegistry.Register("broken", metrics.NewFunctionalGauge(func() int64 {
+		panic("value unavailable")
+	}))
+	for _, name := range []string{"first", "second", "third"} {
+		cntr := metrics.NewCounter()
+		cntr.Inc(1)
+		metricsRegistry.Register(name, cntr)
+	}
+
+	err := pClient.UpdatePrometheusMetricsOnce()
+	var metricErr *MetricError
+	if !errors.As(err, &metricErr) || metricErr.Name != "broken" {
+		t.Fatalf("expected the panic to be returned for broken, got %v", err)
+	}
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 3 {
+		t.Fatalf("expected the three healthy metrics to be exported, got %v", families)
+	}
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "broken") {
+		t.Fatalf("expected the panic to be logged, got %v", logger.lines)
+	}
+}
+
+func TestSnapshotTTL(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSnapshotTTL(100 * time.Millisecond)
+	gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("metric", gm)
+
+	sampleCount := func() uint64 {
+		families, _ := prometheusRegistry.Gather()
+		for _, family := range families {
+			if family.GetName() == "test_subsys_metric_histogram" {
+				return family.GetMetric()[0].GetHistogram().GetSampleCount()
+			}
+		}
+		return 0
+	}
+
+	gm.Update(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	gm.Update(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := sampleCount(); got != 1 {
+		t.Fatalf("expected the cached snapshot to be reused within the TTL, got count %d", got)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := sampleCount(); got != 2 {
+		t.Fatalf("expected a fresh snapshot after the TTL, got count %d", got)
+	}
+}
+
+// sparseHistogram holds a single sample and, like some sample
+// implementations, reports NaN for the percentiles it cannot compute.
+type sparseHistogram struct {
+	metrics.Histogram
+}
+
+func (h sparseHistogram) Snapshot() metrics.Histogram { return h }
+
+func (h sparseHistogram) Percentiles(ps []float64) []float64 {
+	values := make([]float64, len(ps))
+	for ii, p := range ps {
+		if p <= 0.5 {
+			values[ii] = float64(h.Max())
+		} else {
+			values[ii] = math.NaN()
+		}
+	}
+	return values
+}
+
+func TestPercentileNaNFilter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithPercentileNaNFilter()
+	gm := sparseHistogram{metrics.NewHistogram(metrics.NewUniformSample(1028))}
+	gm.Update(7)
+	metricsRegistry.Register("metric", gm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var histogram *dto.Histogram
+	for _, family := range families {
+		if family.GetName() == "test_subsys_metric_histogram" {
+			histogram = family.GetMetric()[0].GetHistogram()
+		}
+	}
+	if histogram == nil {
+		t.Fatalf("histogram was not exported: %v", families)
+	}
+	for _, bucket := range histogram.GetBucket() {
+		if bucket.GetCumulativeCount() != 7 {
+			t.Fatalf("bucket %v: expected NaN to be replaced by 7, got %d", bucket.GetUpperBound(), bucket.GetCumulativeCount())
+		}
+	}
+}
+
+func TestReplaceNaNPercentiles(t *testing.T) {
+	ps := []float64{math.NaN(), 2, math.NaN(), 4, math.NaN()}
+	replaceNaNPercentiles(ps, 9)
+	if fmt.Sprint(ps) != "[9 2 2 4 4]" {
+		t.Fatalf("unexpected replacement %v", ps)
+	}
+}
+
+func TestLibraryVersionInfo(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLibraryVersionInfo()
+
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_library_info" {
+		t.Fatalf("expected a single library_info family, got %v", families)
+	}
+	m := families[0].GetMetric()[0]
+	if m.GetGauge().GetValue() != 1 {
+		t.Fatalf("expected library_info to be 1, got %v", m.GetGauge().GetValue())
+	}
+	labels := make(map[string]string)
+	for _, lp := range m.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	goMod, err := os.ReadFile("go.mod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, path := range map[string]string{
+		"go_metrics":    "github.com/rcrowley/go-metrics",
+		"client_golang": "github.com/prometheus/client_golang",
+	} {
+		if !strings.Contains(string(goMod), "\t"+path+" "+labels[name]+"\n") {
+			t.Fatalf("expected the %s label to be the version of %s in go.mod, got %q", name, path, labels[name])
+		}
+	}
+}
+
+func TestTimerExportSumCount(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerExportMode(TimerExportSumCount)
+	// a two-value sample loses the slow observations to the fast ones
+	tm := metrics.NewCustomTimer(metrics.NewHistogram(metrics.NewUniformSample(2)), metrics.NewMeter())
+	metricsRegistry.Register("latency", tm)
+	tm.Update(250 * time.Millisecond)
+	tm.Update(750 * time.Millisecond)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 2 {
+		t.Fatalf("expected exactly two series for the timer, got %v", families)
+	}
+	expected := map[string]float64{
+		"test_subsys_latency_count":       2,
+		"test_subsys_latency_sum_seconds": 1,
+	}
+	for _, family := range families {
+		want, ok := expected[family.GetName()]
+		if !ok {
+			t.Fatalf("unexpected series %s", family.GetName())
+		}
+		if family.GetType() != dto.MetricType_COUNTER {
+			t.Fatalf("%s: expected a counter, got %v", family.GetName(), family.GetType())
+		}
+		if got := family.GetMetric()[0].GetCounter().GetValue(); got != want {
+			t.Fatalf("%s: expected %v, got %v", family.GetName(), want, got)
+		}
+	}
+
+	last := expected
+	for flush := 0; flush < 2; flush++ {
+		for ii := 0; ii < 100; ii++ {
+			tm.Update(time.Millisecond)
+		}
+		pClient.UpdatePrometheusMetricsOnce()
+		families, _ = prometheusRegistry.Gather()
+		for _, family := range families {
+			got := family.GetMetric()[0].GetCounter().GetValue()
+			if got < last[family.GetName()] {
+				t.Fatalf("flush %d: %s decreased from %v to %v", flush, family.GetName(), last[family.GetName()], got)
+			}
+			last[family.GetName()] = got
+		}
+	}
+	if last["test_subsys_latency_count"] != 202 {
+		t.Fatalf("expected the count to cover every observation, got %v", last)
+	}
+
+	// a timer registered again under the same name starts from zero
+	metricsRegistry.Unregister("latency")
+	pClient.UpdatePrometheusMetricsOnce()
+	if len(pClient.histogramTotals) != 0 {
+		t.Fatalf("expected the totals to be dropped with the timer, got %v", pClient.histogramTotals)
+	}
+	tm = metrics.NewTimer()
+	tm.Update(time.Second)
+	metricsRegistry.Register("latency", tm)
+	pClient.UpdatePrometheusMetricsOnce()
+	families, _ = prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_latency_count" {
+			if got := family.GetMetric()[0].GetCounter().GetValue(); got != 1 {
+				t.Fatalf("expected the new timer's count to start from zero, got %v", got)
+			}
+		}
+	}
+}
+
+func TestDerivedHelpForCountAndSum(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerExportMode(TimerExportSumCount)
+	tm := metrics.NewTimer()
+	tm.Update(time.Second)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]string{
+		"test_subsys_latency_count":       "Total number of observations of latency.",
+		"test_subsys_latency_sum_seconds": "Sum of observed values of latency in seconds.",
+	}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetHelp() != expected[family.GetName()] {
+			t.Fatalf("%s: expected help %q, got %q", family.GetName(), expected[family.GetName()], family.GetHelp())
+		}
+	}
+}
+
+func TestFlushLoopSurvivesPanics(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 10*time.Millisecond).
+		WithFlushPanicsMetric().
+		WithSink(func([]*dto.MetricFamily) error {
+			panic("sink exploded")
+		})
+
+	go pClient.UpdatePrometheusMetrics()
+	time.Sleep(100 * time.Millisecond)
+
+	families, _ := prometheusRegistry.Gather()
+	var panics float64
+	for _, family := range families {
+		if family.GetName() == "test_subsys_flush_panics_total" {
+			panics = family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	if panics < 2 {
+		t.Fatalf("expected the loop to survive repeated panics, counted %v", panics)
+	}
+}
+
+func TestLazyRegistration(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLazyRegistration()
+	metricsRegistry.Register("unused", metrics.NewCounter())
+	used := metrics.NewCounter()
+	metricsRegistry.Register("used", used)
+	metricsRegistry.Register("histogram", metrics.NewHistogram(metrics.NewUniformSample(1028)))
+
+	pClient.UpdatePrometheusMetricsOnce()
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 0 {
+		t.Fatalf("expected no metrics to be registered before first use, got %v", families)
+	}
+
+	used.Inc(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	families, _ = prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_used" {
+		t.Fatalf("expected only the used counter to be registered, got %v", families)
+	}
+
+	used.Clear()
+	pClient.UpdatePrometheusMetricsOnce()
+	families, _ = prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetMetric()[0].GetGauge().GetValue() != 0 {
+		t.Fatalf("expected the used counter to stay registered once it dropped to zero, got %v", families)
+	}
+}
+
+func TestPercentileLeBuckets(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHistogramBuckets([]float64{0.5, 0.9}).
+		WithPercentileLeBuckets()
+	gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("metric", gm)
+	for ii := 1; ii <= 100; ii++ {
+		gm.Update(int64(ii))
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	ps := gm.Percentiles([]float64{0.5, 0.9})
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() != "test_subsys_metric_histogram" {
+			continue
+		}
+		if !strings.Contains(family.GetHelp(), "approximate") {
+			t.Fatalf("expected the help text to flag the buckets as approximate, got %q", family.GetHelp())
+		}
+		buckets := family.GetMetric()[0].GetHistogram().GetBucket()
+		if len(buckets) != 2 {
+			t.Fatalf("expected two buckets, got %v", buckets)
+		}
+		for ii, expectedCount := range []uint64{50, 90} {
+			if buckets[ii].GetUpperBound() != ps[ii] || buckets[ii].GetCumulativeCount() != expectedCount {
+				t.Fatalf("bucket %d: expected le=%v count=%d, got le=%v count=%d", ii, ps[ii], expectedCount, buckets[ii].GetUpperBound(), buckets[ii].GetCumulativeCount())
+			}
+		}
+		return
+	}
+	t.Fatalf("histogram was not exported: %v", families)
+}
+
+func TestNameOrder(t *testing.T) {
+	for _, tc := range []struct {
+		namespaceFirst bool
+		expected       []string
+	}{
+		{true, []string{"test_subsys_metric", "test_subsys_metric_histogram"}},
+		{false, []string{"subsys_test_metric", "subsys_test_metric_histogram"}},
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithNameOrder(tc.namespaceFirst)
+		gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+		gm.Update(1)
+		metricsRegistry.Register("metric", gm)
+
+		pClient.UpdatePrometheusMetricsOnce()
+
+		families, _ := prometheusRegistry.Gather()
+		var names []string
+		for _, family := range families {
+			names = append(names, family.GetName())
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tc.expected) {
+			t.Fatalf("namespaceFirst=%v: expected %v, got %v", tc.namespaceFirst, tc.expected, names)
+		}
+	}
+}
+
+// liveMeter panics if any rate is read off the live meter instead of its
+// snapshot.
+type liveMeter struct {
+	metrics.Meter
+}
+
+func (m liveMeter) Rate1() float64    { panic("Rate1 read from the live meter") }
+func (m liveMeter) Rate5() float64    { panic("Rate5 read from the live meter") }
+func (m liveMeter) Rate15() float64   { panic("Rate15 read from the live meter") }
+func (m liveMeter) RateMean() float64 { panic("RateMean read from the live meter") }
+func (m liveMeter) Count() int64      { panic("Count read from the live meter") }
+
+func TestMeterSeriesReadFromSnapshot(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	logger := &recordingLogger{}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLogger(logger)
+	meter := metrics.NewMeter()
+	meter.Mark(3)
+	metricsRegistry.Register("meter", liveMeter{meter})
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if len(logger.lines) != 0 {
+		t.Fatalf("meter series must be read from the snapshot: %v", logger.lines)
+	}
+	families, _ := prometheusRegistry.Gather()
+	if len(families) == 0 {
+		t.Fatalf("meter was not exported")
+	}
+}
+
+func TestAdaptiveFlushInterval(t *testing.T) {
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithAdaptiveFlushInterval(500*time.Millisecond, 8*time.Second, 0.5)
+
+	interval := pClient.FlushInterval
+	var grown []time.Duration
+	for ii := 0; ii < 5; ii++ {
+		interval = pClient.nextFlushInterval(interval, 3*time.Second)
+		grown = append(grown, interval)
+	}
+	if fmt.Sprint(grown) != "[2s 4s 8s 8s 8s]" {
+		t.Fatalf("expected slow flushes to grow the interval up to the max, got %v", grown)
+	}
+
+	interval = pClient.nextFlushInterval(interval, 1500*time.Millisecond)
+	if interval != 8*time.Second {
+		t.Fatalf("expected a flush within budget to keep the interval, got %v", interval)
+	}
+
+	var shrunk []time.Duration
+	for ii := 0; ii < 6; ii++ {
+		interval = pClient.nextFlushInterval(interval, time.Millisecond)
+		shrunk = append(shrunk, interval)
+	}
+	if fmt.Sprint(shrunk) != "[4s 2s 1s 500ms 500ms 500ms]" {
+		t.Fatalf("expected fast flushes to shrink the interval down to the min, got %v", shrunk)
+	}
+}
+
+func TestAdaptiveFlushLoopStartsAtFlushInterval(t *testing.T) {
+	flushed := make(chan time.Time, 10)
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 200*time.Millisecond).
+		WithAdaptiveFlushInterval(50*time.Millisecond, time.Second, 0.5).
+		WithSink(func([]*dto.MetricFamily) error {
+			flushed <- time.Now()
+			return nil
+		})
+
+	start := time.Now()
+	go pClient.UpdatePrometheusMetrics()
+	defer pClient.Stop()
+	first := <-flushed
+	if elapsed := first.Sub(start); elapsed < 180*time.Millisecond {
+		t.Fatalf("expected the first flush after FlushInterval, got it after %v", elapsed)
+	}
+}
+
+func TestCumulativeHistogram(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCumulativeHistogram(1, 3, 5)
+	gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	metricsRegistry.Register("metric", gm)
+
+	histogram := func() *dto.Histogram {
+		families, _ := prometheusRegistry.Gather()
+		for _, family := range families {
+			if family.GetName() == "test_subsys_metric_histogram" {
+				return family.GetMetric()[0].GetHistogram()
+			}
+		}
+		t.Fatalf("histogram was not exported: %v", families)
+		return nil
+	}
+
+	var counts []uint64
+	var sums []float64
+	var bucketCounts [][]uint64
+	var lastBuckets []uint64
+	for _, observations := range [][]int64{{2, 2}, {}, {4}, {4, 4, 4}} {
+		for _, v := range observations {
+			gm.Update(v)
+		}
+		if len(observations) == 1 {
+			// a cleared histogram must not shrink the exported totals
+			gm.Clear()
+			gm.Update(observations[0])
+		}
+		pClient.UpdatePrometheusMetricsOnce()
+		counts = append(counts, histogram().GetSampleCount())
+		sums = append(sums, histogram().GetSampleSum())
+
+		var buckets []uint64
+		var bounds []float64
+		for _, bucket := range histogram().GetBucket() {
+			buckets = append(buckets, bucket.GetCumulativeCount())
+			bounds = append(bounds, bucket.GetUpperBound())
+		}
+		if fmt.Sprint(bounds) != "[1 3 5]" {
+			t.Fatalf("expected the bucket bounds to stay [1 3 5] across flushes, got %v", bounds)
+		}
+		for ii, b := range buckets {
+			if (ii > 0 && b < buckets[ii-1]) || b > histogram().GetSampleCount() || (ii < len(lastBuckets) && b < lastBuckets[ii]) {
+				t.Fatalf("expected monotonic bucket counts within the count, got %v after %v", buckets, lastBuckets)
+			}
+		}
+		lastBuckets = buckets
+		bucketCounts = append(bucketCounts, buckets)
+	}
+
+	if fmt.Sprint(counts) != "[2 2 3 6]" {
+		t.Fatalf("expected the count to grow monotonically without double counting, got %v", counts)
+	}
+	if fmt.Sprint(sums) != "[4 4 8 20]" {
+		t.Fatalf("expected the sum to grow monotonically, got %v", sums)
+	}
+	if fmt.Sprint(bucketCounts) != "[[0 2 2] [0 2 2] [0 2 3] [0 2 6]]" {
+		t.Fatalf("expected the new observations to be added to the buckets they fall in, got %v", bucketCounts)
+	}
+
+	server := httptest.NewServer(pClient.Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "test_subsys_metric_histogram_bucket{le=\"+Inf\"} 6\n") ||
+		!strings.Contains(string(body), "test_subsys_metric_histogram_count 6\n") {
+		t.Fatalf("expected the +Inf bucket to equal the count, got\n%s", body)
+	}
+}
+
+func TestChangeDetection(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	flushes := 0
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithChangeDetection(3).
+		WithSink(func([]*dto.MetricFamily) error {
+			flushes++
+			return nil
+		})
+	metricsRegistry.Register("first", metrics.NewCounter())
+
+	var history []int
+	tick := func() {
+		pClient.flushRecovering(false)
+		history = append(history, flushes)
+	}
+
+	tick() // new metric set
+	tick()
+	tick()
+	metricsRegistry.Register("second", metrics.NewCounter())
+	tick() // changed metric set
+	tick()
+	tick()
+	tick() // third tick without changes refreshes values
+	metricsRegistry.Unregister("first")
+	tick() // changed metric set
+
+	if fmt.Sprint(history) != "[1 1 1 2 2 2 3 4]" {
+		t.Fatalf("expected full flushes only on metric set changes and every third tick, got %v", history)
+	}
+}
+
+func TestChangeDetectionFlushesOnStop(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Hour).
+		WithChangeDetection(100)
+	gm := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gm)
+	pClient.flushRecovering(false)
+
+	go pClient.UpdatePrometheusMetrics()
+	for !pClient.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+	gm.Update(7)
+	pClient.Stop()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetMetric()[0].GetGauge().GetValue() != 7 {
+		t.Fatalf("expected Stop to flush the value updated after the last tick, got %v", families)
+	}
+}
+
+func TestGaugeSignificantDigits(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithGaugeSignificantDigits(4)
+	gm := metrics.NewGaugeFloat64()
+	gm.Update(3.14159265358979)
+	metricsRegistry.Register("pi", gm)
+	large := metrics.NewGauge()
+	large.Update(123456789)
+	metricsRegistry.Register("large", large)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]float64{
+		"test_subsys_pi":    3.142,
+		"test_subsys_large": 123500000,
+	}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if got := family.GetMetric()[0].GetGauge().GetValue(); got != expected[family.GetName()] {
+			t.Fatalf("%s: expected %v, got %v", family.GetName(), expected[family.GetName()], got)
+		}
+	}
+}
+
+func TestCombinedTimerCollector(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCombinedTimerCollector()
+	tm := metrics.NewTimer()
+	metricsRegistry.Register("latency", tm)
+	tm.Update(100 * time.Millisecond)
+
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+	if len(pClient.timerCollectors) != 1 || len(pClient.gauges) != 0 || len(pClient.customMetrics) != 0 {
+		t.Fatalf("expected a single collector for the timer")
+	}
+
+	// values recorded after the flush are picked up at collection time
+	tm.Update(300 * time.Millisecond)
+
+	families, _ := prometheusRegistry.Gather()
+	byName := make(map[string]*dto.Metric)
+	for _, family := range families {
+		byName[family.GetName()] = family.GetMetric()[0]
+	}
+	if len(byName) != 5 || byName["test_subsys_latency"] == nil || byName["test_subsys_latency_mean"] == nil {
+		t.Fatalf("expected the flushed timer series and the mean, got %v", families)
+	}
+	histogram := byName["test_subsys_latency_timer"].GetHistogram()
+	mean := byName["test_subsys_latency_mean"].GetGauge().GetValue()
+	if histogram.GetSampleCount() != 2 {
+		t.Fatalf("expected the histogram to be collected from a fresh snapshot, got count %d", histogram.GetSampleCount())
+	}
+	if histogram.GetSampleSum()/float64(histogram.GetSampleCount()) != mean {
+		t.Fatalf("expected the mean %v to match the histogram's sum/count %v/%d", mean, histogram.GetSampleSum(), histogram.GetSampleCount())
+	}
+}
+
+func TestCombinedTimerCollectorMatchesFlush(t *testing.T) {
+	options := func(c *PrometheusConfig) *PrometheusConfig {
+		return c.WithStdDev().
+			WithCountSum().
+			WithTimerRates(TimerRate5, TimerRateMean).
+			WithApdex("latency", 200*time.Millisecond).
+			WithSummaryExport([]float64{0.5, 0.99})
+	}
+	names := func(combined bool) []string {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := options(NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second))
+		if combined {
+			pClient.WithCombinedTimerCollector()
+		}
+		tm := metrics.NewTimer()
+		metricsRegistry.Register("latency", tm)
+		tm.Update(100 * time.Millisecond)
+		pClient.UpdatePrometheusMetricsOnce()
+
+		families, err := prometheusRegistry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, family := range families {
+			names = append(names, family.GetName()+" "+family.GetType().String())
+		}
+		return names
+	}
+
+	flushed := append(names(false), "test_subsys_latency_mean GAUGE")
+	sort.Strings(flushed)
+	if combined := names(true); fmt.Sprint(combined) != fmt.Sprint(flushed) {
+		t.Fatalf("expected the combined collector to export %v, got %v", flushed, combined)
+	}
+}
+
+func TestCombinedTimerCollectorLogsIgnoredOptions(t *testing.T) {
+	logger := &recordingLogger{}
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithLogger(logger).
+		WithCombinedTimerCollector().
+		WithCumulativeHistogram()
+	metricsRegistry.Register("latency", metrics.NewTimer())
+
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "latency") {
+		t.Fatalf("expected the ignored options to be logged once for the timer, got %v", logger.lines)
+	}
+}
+
+func TestNameChanges(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	metricsRegistry.Register("http.requests", metrics.NewCounter())
+	metricsRegistry.Register("queue depth", metrics.NewGauge())
+	metricsRegistry.Register("already_clean", metrics.NewGauge())
+
+	changes := pClient.NameChanges()
+
+	expected := map[string]string{
+		"http.requests": "test_subsys_http_requests",
+		"queue depth":   "test_subsys_queue_depth",
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+}
+
+func TestNameChangesMatchExportedNames(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTrimPrefix("app.").
+		WithReservedSuffixRename().
+		WithCountersAsCounters().
+		WithNameMapper(func(name string) (string, bool) {
+			return strings.Replace(name, "legacy", "current", 1), name == "app.skipped"
+		})
+	metricsRegistry.Register("app.legacy.requests", metrics.NewCounter())
+	metricsRegistry.Register("app.queue_count", metrics.NewGauge())
+	metricsRegistry.Register("app.skipped", metrics.NewGauge())
+
+	changes := pClient.NameChanges()
+	pClient.UpdatePrometheusMetricsOnce()
+	families, _ := prometheusRegistry.Gather()
+	var exported []string
+	for _, family := range families {
+		exported = append(exported, family.GetName())
+	}
+
+	expected := map[string]string{
+		"app.legacy.requests": "test_subsys_current_requests_total",
+		"app.queue_count":     "test_subsys_queue_count_value",
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	if fmt.Sprint(exported) != "[test_subsys_current_requests_total test_subsys_queue_count_value]" {
+		t.Fatalf("expected the reported names to be exported, got %v", exported)
+	}
+}
+
+// fixedRateTimer reports a known mean rate from its snapshot.
+type fixedRateTimer struct {
+	metrics.Timer
+}
+
+func (t fixedRateTimer) Snapshot() metrics.Timer { return t }
+func (t fixedRateTimer) RateMean() float64       { return 42.5 }
+
+func TestTimerRateMean(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	tm := fixedRateTimer{metrics.NewTimer()}
+	tm.Update(time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_latency_rate_mean" {
+			if got := family.GetMetric()[0].GetGauge().GetValue(); got != 42.5 {
+				t.Fatalf("expected the timer mean rate 42.5, got %v", got)
+			}
+			return
+		}
+	}
+	t.Fatalf("timer mean rate was not exported: %v", families)
+}
+
+func TestSubsystemAsLabel(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSubsystemAsLabel()
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	gm.Update(1)
+	metricsRegistry.Register("metric", gm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+		labels := family.GetMetric()[0].GetLabel()
+		if len(labels) != 1 || labels[0].GetName() != "subsystem" || labels[0].GetValue() != "subsys" {
+			t.Fatalf("%s: expected a subsystem label, got %v", family.GetName(), labels)
+		}
+	}
+	expected := []string{"test_counter", "test_metric", "test_metric_histogram"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("expected the subsystem to be left out of the names %v, got %v", expected, names)
+	}
+}
+
+func TestOnRegistryDiff(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	var diffs []string
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		OnRegistryDiff(func(added, removed []string) {
+			diffs = append(diffs, fmt.Sprintf("+%v -%v", added, removed))
+		})
+
+	metricsRegistry.Register("a", metrics.NewCounter())
+	metricsRegistry.Register("b", metrics.NewCounter())
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+	metricsRegistry.Register("c", metrics.NewCounter())
+	metricsRegistry.Unregister("a")
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := []string{"+[a b] -[]", "+[] -[]", "+[c] -[a]"}
+	if fmt.Sprint(diffs) != fmt.Sprint(expected) {
+		t.Fatalf("expected diffs %v, got %v", expected, diffs)
+	}
+}
+
+func TestInvalidMetricLabelsAreReported(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	logger := &recordingLogger{}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLogger(logger).
+		WithMetricLabels(map[string]prometheus.Labels{
+			"metric": {"bad-label": "x"},
+		})
+	gm := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	gm.Update(1)
+	metricsRegistry.Register("metric", gm)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "bad-label") {
+		t.Fatalf("expected the label mismatch to be reported, got %v", logger.lines)
+	}
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_counter" {
+		t.Fatalf("expected only the counter to be exported, got %v", families)
+	}
+}
+
+func TestConstMetricErrorsAreReported(t *testing.T) {
+	logger := &recordingLogger{}
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithLogger(logger).
+		WithMetricLabels(map[string]prometheus.Labels{
+			"latency": {"__reserved": "x"},
+		})
+
+	pClient.constMetricFromNameAndValue("latency", "count", prometheus.CounterValue, 1)
+
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "latency_count") {
+		t.Fatalf("expected the construction error to be reported, got %v", logger.lines)
+	}
+}
+
+// extraMetricsRegistry also iterates over metrics the standard registry
+// refuses to hold, such as bare EWMAs.
+type extraMetricsRegistry struct {
+	metrics.Registry
+	extra map[string]interface{}
+}
+
+func (r extraMetricsRegistry) Each(f func(string, interface{})) {
+	r.Registry.Each(f)
+	for name, metric := range r.extra {
+		f(name, metric)
+	}
+}
+
+func TestEWMAExported(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	ewma := metrics.NewEWMA1()
+	ewma.Update(300)
+	ewma.Tick()
+	metricsRegistry := extraMetricsRegistry{metrics.NewRegistry(), map[string]interface{}{"ewma": ewma}}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_ewma" {
+		t.Fatalf("expected the EWMA to be exported, got %v", families)
+	}
+	if got := families[0].GetMetric()[0].GetGauge().GetValue(); got != ewma.Rate() || got == 0 {
+		t.Fatalf("expected the EWMA rate %v, got %v", ewma.Rate(), got)
+	}
+}
+
+func TestTypeInHelp(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTypeInHelp()
+	metricsRegistry.Register("requests", metrics.NewCounter())
+	tm := metrics.NewTimer()
+	tm.Update(time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]string{
+		"test_subsys_requests":          "requests (go-metrics Counter)",
+		"test_subsys_latency":           "latency (go-metrics Timer)",
+		"test_subsys_latency_rate_mean": "Mean rate of events of latency per second since it was created. (go-metrics Timer)",
+		"test_subsys_latency_timer":     "latency (go-metrics Timer)",
+		"test_subsys_latency_variance":  "Variance of latency in its unit squared. (go-metrics Timer)",
+	}
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != len(expected) {
+		t.Fatalf("expected %d families, got %v", len(expected), families)
+	}
+	for _, family := range families {
+		if family.GetHelp() != expected[family.GetName()] {
+			t.Fatalf("%s: expected help %q, got %q", family.GetName(), expected[family.GetName()], family.GetHelp())
+		}
+	}
+}
+
+func TestFlushStatsChannel(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	stats := make(chan FlushStats, 2)
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithFlushStatsChannel(stats)
+	metricsRegistry.Register("first", metrics.NewCounter())
+	metricsRegistry.Register("second", metrics.NewGauge())
+
+	for ii := 0; ii < 3; ii++ {
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+
+	for ii := 0; ii < 2; ii++ {
+		s := <-stats
+		if s.Metrics != 2 || s.Start.IsZero() {
+			t.Fatalf("unexpected flush stats %+v", s)
+		}
+	}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_flush_stats_dropped_total" {
+			if got := family.GetMetric()[0].GetCounter().GetValue(); got != 1 {
+				t.Fatalf("expected one dropped flush stats, got %v", got)
+			}
+			return
+		}
+	}
+	t.Fatalf("flush_stats_dropped_total was not exported: %v", families)
+}
+
+func TestUpdateMetricOnce(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	cntr := metrics.NewCounter()
+	cntr.Inc(4)
+	metricsRegistry.Register("known", cntr)
+	metricsRegistry.Register("other", metrics.NewCounter())
+
+	if err := pClient.UpdateMetricOnce("unknown"); err == nil {
+		t.Fatalf("expected an error for an unknown metric")
+	}
+	if metricsRegistry.Get("unknown") != nil {
+		t.Fatalf("UpdateMetricOnce must not register unknown metrics")
+	}
+
+	if err := pClient.UpdateMetricOnce("known"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_known" || families[0].GetMetric()[0].GetGauge().GetValue() != 4 {
+		t.Fatalf("expected only the known metric to be exported, got %v", families)
+	}
+}
+
+func TestDerivedStatsInfix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDerivedStatsInfix("stats")
+	tm := metrics.NewTimer()
+	tm.Update(time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	expected := []string{"test_subsys_latency", "test_subsys_latency_stats_rate_mean", "test_subsys_latency_stats_timer", "test_subsys_latency_stats_variance"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestInvalidDerivedStatsInfixIgnored(t *testing.T) {
+	for _, loggerFirst := range []bool{true, false} {
+		logger := &recordingLogger{}
+		pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+		if loggerFirst {
+			pClient.WithLogger(logger).WithDerivedStatsInfix("stats/v2")
+		} else {
+			pClient.WithDerivedStatsInfix("stats/v2").WithLogger(logger)
+		}
+		pClient.UpdatePrometheusMetricsOnce()
+		pClient.UpdatePrometheusMetricsOnce()
+
+		if pClient.derivedInfix != "" {
+			t.Fatalf("expected the invalid infix to be ignored, got %q", pClient.derivedInfix)
+		}
+		if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "stats/v2") {
+			t.Fatalf("expected the invalid infix to be logged once (logger first %v), got %v", loggerFirst, logger.lines)
+		}
+	}
+}
+
+func TestScrapeCounter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithScrapeCounter()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	var scrapes []float64
+	for ii := 0; ii < 3; ii++ {
+		families, _ := prometheusRegistry.Gather()
+		for _, family := range families {
+			if family.GetName() == "test_subsys_scrapes_total" {
+				scrapes = append(scrapes, family.GetMetric()[0].GetCounter().GetValue())
+			}
+		}
+	}
+	if fmt.Sprint(scrapes) != "[1 2 3]" {
+		t.Fatalf("expected the scrape counter to count every gather, got %v", scrapes)
+	}
+}
+
+func TestRegistryWalker(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	appRegistry := metrics.NewRegistry()
+	libRegistry := metrics.NewRegistry()
+	appRegistry.Register("app", metrics.NewCounter())
+	libRegistry.Register("lib", metrics.NewGauge())
+	pClient := NewPrometheusProvider(appRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithRegistryWalker(func(fn func(name string, metric interface{})) {
+			appRegistry.Each(fn)
+			libRegistry.Each(fn)
+		})
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if fmt.Sprint(names) != "[test_subsys_app test_subsys_lib]" {
+		t.Fatalf("expected metrics from both sources, got %v", names)
+	}
+}
+
+func TestApdex(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithApdex("latency", 200*time.Millisecond)
+	tm := metrics.NewTimer()
+	metricsRegistry.Register("latency", tm)
+	// 600 satisfied, 200 tolerating and 200 frustrated requests:
+	// (600 + 200/2) / 1000 = 0.7
+	for ii := 0; ii < 600; ii++ {
+		tm.Update(100 * time.Millisecond)
+	}
+	for ii := 0; ii < 200; ii++ {
+		tm.Update(500 * time.Millisecond)
+	}
+	for ii := 0; ii < 200; ii++ {
+		tm.Update(2 * time.Second)
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_latency_apdex" {
+			if got := family.GetMetric()[0].GetGauge().GetValue(); math.Abs(got-0.7) > 0.005 {
+				t.Fatalf("expected an Apdex score of 0.7, got %v", got)
+			}
+			return
+		}
+	}
+	t.Fatalf("apdex was not exported: %v", families)
+}
+
+// countingTimer counts how often its snapshot is taken.
+type countingTimer struct {
+	metrics.Timer
+	snapshots *int
+}
+
+func (t countingTimer) Snapshot() metrics.Timer {
+	*t.snapshots++
+	return t.Timer.Snapshot()
+}
+
+func TestSamplingRate(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSamplingRate("Timer", 3)
+	snapshots := 0
+	metricsRegistry.Register("latency", countingTimer{metrics.NewTimer(), &snapshots})
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+
+	for ii := 0; ii < 6; ii++ {
+		gauge.Update(int64(ii))
+		pClient.UpdatePrometheusMetricsOnce()
+
+		families, _ := prometheusRegistry.Gather()
+		for _, family := range families {
+			if family.GetName() == "test_subsys_gauge" {
+				if got := family.GetMetric()[0].GetGauge().GetValue(); got != float64(ii) {
+					t.Fatalf("flush %d: expected gauge %d, got %v", ii, ii, got)
+				}
+			}
+		}
+	}
+	if snapshots != 2 {
+		t.Fatalf("expected the timer to be processed on 2 of 6 flushes, got %d", snapshots)
+	}
+}
+
+func TestConfigInfoMetric(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConfigInfoMetric()
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() != "test_subsys_exporter_config_info" {
+			continue
+		}
+		labels := make(map[string]string)
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["flush_interval"] != "1s" || labels["namespace"] != "test" || labels["subsystem"] != "subsys" {
+			t.Fatalf("unexpected config info labels: %v", labels)
+		}
+		if got := family.GetMetric()[0].GetGauge().GetValue(); got != 1 {
+			t.Fatalf("expected config info value 1, got %v", got)
+		}
+		return
+	}
+	t.Fatalf("exporter_config_info was not exported: %v", families)
+}
+
+func TestTimerVariance(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	tm := metrics.NewTimer()
+	tm.Update(1 * time.Millisecond)
+	tm.Update(3 * time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_latency_variance" {
+			stddev := tm.StdDev()
+			if got := family.GetMetric()[0].GetGauge().GetValue(); math.Abs(got-stddev*stddev) > 1e-6*got {
+				t.Fatalf("expected variance %v, got %v", stddev*stddev, got)
+			}
+			return
+		}
+	}
+	t.Fatalf("variance was not exported: %v", families)
+}
+
+func TestLastFlushErrors(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	for _, name := range []string{"first", "second"} {
+		prometheusRegistry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "test_subsys_" + name,
+			Help: "conflicting help",
+		}))
+		metricsRegistry.Register(name, metrics.NewGauge())
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if errs := pClient.LastFlushErrors(); len(errs) != 2 {
+		t.Fatalf("expected 2 registration errors, got %v", errs)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	if errs := pClient.LastFlushErrors(); len(errs) != 0 {
+		t.Fatalf("expected no registration errors once the gauges exist, got %v", errs)
+	}
+}
+
+func TestScanLimit(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithScanLimit(2)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		g := metrics.NewGauge()
+		g.Update(1)
+		metricsRegistry.Register(name, g)
+	}
+
+	exported := func() int {
+		families, _ := prometheusRegistry.Gather()
+		return len(families)
+	}
+	for flush, expected := range []int{2, 4, 5} {
+		pClient.UpdatePrometheusMetricsOnce()
+		if got := exported(); got != expected {
+			t.Fatalf("flush %d: expected %d metrics exported, got %d", flush, expected, got)
+		}
+	}
+}
+
+func TestFlattenKeyCache(t *testing.T) {
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	for ii := 0; ii < 2; ii++ {
+		if got := pClient.flattenKey("http.requests-total by=code"); got != "http_requests_total_by_code" {
+			t.Fatalf("lookup %d: unexpected flattened key %q", ii, got)
+		}
+	}
+	if len(pClient.flatKeys) != 1 {
+		t.Fatalf("expected 1 cached key, got %v", pClient.flatKeys)
+	}
+}
+
+func BenchmarkUpdatePrometheusMetricsOnce(b *testing.B) {
+	metricsRegistry := metrics.NewRegistry()
+	for ii := 0; ii < 1000; ii++ {
+		metricsRegistry.Register(fmt.Sprintf("service.requests-%d", ii), metrics.NewGauge())
+	}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ii := 0; ii < b.N; ii++ {
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+}
+
+func TestScrapeGatherer(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	gauge := metrics.NewGauge()
+	metricsRegistry.Register("gauge", gauge)
+	gatherer := pClient.ScrapeGatherer(prometheusRegistry)
+
+	for _, val := range []int64{3, 7} {
+		gauge.Update(val)
+		families, err := gatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(families) != 1 || families[0].GetMetric()[0].GetGauge().GetValue() != float64(val) {
+			t.Fatalf("expected the gauge at %d on scrape, got %v", val, families)
+		}
+	}
+}
+
+func TestStop(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	pClient.Stop()
+	pClient.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("UpdatePrometheusMetrics did not return after Stop")
+	}
+}
+
+func TestNewPrometheusProviderWithOptions(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProviderWithOptions(metricsRegistry,
+		WithNamespace("test"),
+		WithSubsystem("subsys"),
+		WithRegisterer(prometheusRegistry),
+		WithFlushInterval(5*time.Second),
+		WithHistogramBuckets([]float64{0.5}),
+		Configure((*PrometheusConfig).WithStdDev),
+		Configure(func(c *PrometheusConfig) *PrometheusConfig {
+			return c.WithApdex("timer", time.Second)
+		}),
+	)
+	if pClient.FlushInterval != 5*time.Second {
+		t.Fatalf("expected a 5s flush interval, got %v", pClient.FlushInterval)
+	}
+	if !pClient.stdDev || pClient.apdexTargets["timer"] != time.Second {
+		t.Fatalf("expected Configure to apply the methods")
+	}
+	s := metrics.NewExpDecaySample(1028, 0.015)
+	h := metrics.NewHistogram(s)
+	h.Update(10)
+	metricsRegistry.Register("hist", h)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_hist_histogram" {
+			if buckets := family.GetMetric()[0].GetHistogram().GetBucket(); len(buckets) != 1 {
+				t.Fatalf("expected 1 bucket, got %v", buckets)
+			}
+			return
+		}
+	}
+	t.Fatalf("histogram was not exported: %v", families)
+}
+
+func TestCountersAsCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCountersAsCounters()
+	requests := metrics.NewCounter()
+	metricsRegistry.Register("requests", requests)
+	metricsRegistry.Register("errors_total", metrics.NewCounter())
+
+	for _, inc := range []int64{2, 3} {
+		requests.Inc(inc)
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+
+	families, _ := prometheusRegistry.Gather()
+	names := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		names[family.GetName()] = family
+	}
+	if _, ok := names["test_subsys_errors_total"]; !ok {
+		t.Fatalf("expected errors_total to keep a single _total suffix, got %v", families)
+	}
+	family, ok := names["test_subsys_requests_total"]
+	if !ok {
+		t.Fatalf("requests_total was not exported: %v", families)
+	}
+	if family.GetType() != dto.MetricType_COUNTER {
+		t.Fatalf("expected a counter, got %v", family.GetType())
+	}
+	if got := family.GetMetric()[0].GetCounter().GetValue(); got != 5 {
+		t.Fatalf("expected requests_total 5, got %v", got)
+	}
+}
+
+func TestConstLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithConstLabels(prometheus.Labels{"service": "payments", "region": "eu-1"}).
+		WithMetricLabels(map[string]prometheus.Labels{"hist": {"region": "us-1"}})
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	h := metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+	h.Update(10)
+	metricsRegistry.Register("hist", h)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]string{
+		"test_subsys_gauge":          "region=eu-1,service=payments",
+		"test_subsys_hist":           "region=us-1,service=payments",
+		"test_subsys_hist_histogram": "region=us-1,service=payments",
+	}
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != len(expected) {
+		t.Fatalf("expected %d families, got %v", len(expected), families)
+	}
+	for _, family := range families {
+		var labels []string
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		if got := strings.Join(labels, ","); got != expected[family.GetName()] {
+			t.Fatalf("%s: expected labels %s, got %s", family.GetName(), expected[family.GetName()], got)
+		}
+	}
+}
+
+func TestNameParser(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNameParser(SemicolonLabels)
+	for name, val := range map[string]int64{
+		"http_requests;method=GET;code=200":  3,
+		"http_requests;method=POST;code=500": 1,
+	} {
+		g := metrics.NewGauge()
+		g.Update(val)
+		metricsRegistry.Register(name, g)
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_http_requests" {
+		t.Fatalf("expected a single http_requests family, got %v", families)
+	}
+	got := make(map[string]float64)
+	for _, metric := range families[0].GetMetric() {
+		var labels []string
+		for _, label := range metric.GetLabel() {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		got[strings.Join(labels, ",")] = metric.GetGauge().GetValue()
+	}
+	expected := map[string]float64{"code=200,method=GET": 3, "code=500,method=POST": 1}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected series %v, got %v", expected, got)
+	}
+}
+
+func TestDropHighCardinalityLabels(t *testing.T) {
+	logger := &recordingLogger{}
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLogger(logger).
+		WithNameParser(SemicolonLabels).
+		WithExportDropHighCardinalityLabels(2)
+	register := func(ids ...string) {
+		for _, id := range ids {
+			metricsRegistry.Register("requests;method=GET;id="+id, metrics.NewGauge())
+		}
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+
+	register("1")
+	register("2")
+	register("3", "4", "5")
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	names := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		names[family.GetName()] = family
+	}
+	if got := names["test_subsys_register_errors_total"].GetMetric()[0].GetCounter().GetValue(); got != 2 {
+		t.Fatalf("expected the two collapsed duplicates to be reported once each, got %v", got)
+	}
+	var series []string
+	for _, metric := range names["test_subsys_requests"].GetMetric() {
+		var labels []string
+		for _, label := range metric.GetLabel() {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		series = append(series, strings.Join(labels, ","))
+	}
+	sort.Strings(series)
+	expected := []string{"id=1,method=GET", "id=2,method=GET", "id=__too_many__,method=GET"}
+	if fmt.Sprint(series) != fmt.Sprint(expected) {
+		t.Fatalf("expected the new ids to collapse into __too_many__, got %v", series)
+	}
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "label id") {
+		t.Fatalf("expected the overflow of id to be logged once, got %v", logger.lines)
+	}
+}
+
+func TestMetricBuckets(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMetricBuckets("tuned", []float64{0.5, 0.9})
+	for _, name := range []string{"tuned", "default"} {
+		h := metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))
+		h.Update(10)
+		metricsRegistry.Register(name, h)
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]int{"test_subsys_tuned_histogram": 2, "test_subsys_default_histogram": 8}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		want, ok := expected[family.GetName()]
+		if !ok {
+			continue
+		}
+		if got := len(family.GetMetric()[0].GetHistogram().GetBucket()); got != want {
+			t.Fatalf("%s: expected %d buckets, got %d", family.GetName(), want, got)
+		}
+		delete(expected, family.GetName())
+	}
+	if len(expected) != 0 {
+		t.Fatalf("histograms not exported: %v", expected)
+	}
+}
+
+func TestTimerUnit(t *testing.T) {
+	for _, combined := range []bool{false, true} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithTimerUnit(time.Second, true)
+		if combined {
+			pClient.WithCombinedTimerCollector()
+		}
+		for _, name := range []string{"latency", "wait_seconds"} {
+			tm := metrics.NewTimer()
+			tm.Update(1500 * time.Millisecond)
+			tm.Update(500 * time.Millisecond)
+			metricsRegistry.Register(name, tm)
+		}
+
+		pClient.UpdatePrometheusMetricsOnce()
+
+		families, _ := prometheusRegistry.Gather()
+		names := make(map[string]*dto.MetricFamily)
+		for _, family := range families {
+			names[family.GetName()] = family
+		}
+		if _, ok := names["test_subsys_wait_seconds_timer"]; !ok {
+			t.Fatalf("expected no second unit suffix on wait_seconds, got %v", families)
+		}
+		family, ok := names["test_subsys_latency_timer_seconds"]
+		if !ok {
+			t.Fatalf("latency_timer_seconds was not exported: %v", families)
+		}
+		if got := family.GetMetric()[0].GetHistogram().GetSampleSum(); got != 2 {
+			t.Fatalf("expected a sum of 2 seconds, got %v", got)
+		}
+		for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+			if got := bucket.GetCumulativeCount(); got > 1 {
+				t.Fatalf("expected the percentile of bucket %v in seconds (combined %v), got %v", bucket.GetUpperBound(), combined, got)
+			}
+		}
+		if got := names["test_subsys_latency_variance"].GetMetric()[0].GetGauge().GetValue(); math.Abs(got-0.25) > 1e-9 {
+			t.Fatalf("expected a variance of 0.25 seconds squared, got %v", got)
+		}
+	}
+}
+
+func TestSummaryExport(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSummaryExport([]float64{0.5, 0.99})
+	h := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	for ii := int64(1); ii <= 100; ii++ {
+		h.Update(ii)
+	}
+	metricsRegistry.Register("hist", h)
+	tm := metrics.NewTimer()
+	tm.Update(time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	found := 0
+	for _, family := range families {
+		switch family.GetName() {
+		case "test_subsys_hist_histogram":
+			summary := family.GetMetric()[0].GetSummary()
+			if family.GetType() != dto.MetricType_SUMMARY || summary.GetSampleCount() != 100 || summary.GetSampleSum() != 5050 {
+				t.Fatalf("unexpected histogram summary: %v", family)
+			}
+			quantiles := summary.GetQuantile()
+			if len(quantiles) != 2 || quantiles[0].GetQuantile() != 0.5 || quantiles[0].GetValue() != 50.5 {
+				t.Fatalf("unexpected quantiles: %v", quantiles)
+			}
+			found++
+		case "test_subsys_latency_timer":
+			if family.GetType() != dto.MetricType_SUMMARY {
+				t.Fatalf("expected the timer as a summary, got %v", family)
+			}
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("expected both summaries, got %v", families)
+	}
+}
+
+func TestNativeHistograms(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNativeHistograms(2)
+	h := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	for _, v := range []int64{0, 1, 2, 3, 4, 4, -1} {
+		h.Update(v)
+	}
+	metricsRegistry.Register("hist", h)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() != "test_subsys_hist_histogram" {
+			continue
+		}
+		histogram := family.GetMetric()[0].GetHistogram()
+		if histogram.GetSchema() != 0 || histogram.GetSampleCount() != 7 || histogram.GetSampleSum() != 13 || histogram.GetZeroCount() != 1 {
+			t.Fatalf("unexpected native histogram: %v", histogram)
+		}
+		// Schema 0 buckets are (0.5,1], (1,2] and (2,4] at indexes 0 to 2.
+		var counts []int64
+		var count int64
+		for _, delta := range histogram.GetPositiveDelta() {
+			count += delta
+			counts = append(counts, count)
+		}
+		if fmt.Sprint(counts) != "[1 1 3]" || histogram.GetPositiveSpan()[0].GetOffset() != 0 {
+			t.Fatalf("unexpected positive buckets %v in %v", counts, histogram)
+		}
+		if len(histogram.GetNegativeDelta()) != 1 {
+			t.Fatalf("expected a single negative bucket, got %v", histogram)
+		}
+		return
+	}
+	t.Fatalf("native histogram was not exported: %v", families)
+}
+
+func TestNameMapper(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNameMapper(func(name string) (string, bool) {
+			if strings.HasPrefix(name, "debug.") {
+				return "", true
+			}
+			return strings.TrimPrefix(name, "com.example.service."), false
+		})
+	metricsRegistry.Register("com.example.service.http.requests", metrics.NewGauge())
+	metricsRegistry.Register("debug.allocations", metrics.NewGauge())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_http_requests" {
+		t.Fatalf("expected only test_subsys_http_requests, got %v", families)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithFilter(func(name string, metric interface{}) bool {
+			_, isTimer := metric.(metrics.Timer)
+			return !isTimer && name != "denied"
+		})
+	metricsRegistry.Register("allowed", metrics.NewGauge())
+	metricsRegistry.Register("denied", metrics.NewGauge())
+	metricsRegistry.Register("latency", metrics.NewTimer())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_allowed" {
+		t.Fatalf("expected only test_subsys_allowed, got %v", families)
+	}
+}
+
+func TestUnregisterRemovedMetrics(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	h := metrics.NewHistogram(metrics.NewUniformSample(1028))
+	h.Update(10)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("hist", h)
+
+	gathered := func() int {
+		families, _ := prometheusRegistry.Gather()
+		return len(families)
+	}
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := gathered(); got != 3 {
+		t.Fatalf("expected 3 families, got %d", got)
+	}
+
+	metricsRegistry.Unregister("gauge")
+	metricsRegistry.Unregister("hist")
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := gathered(); got != 0 {
+		t.Fatalf("expected the removed metrics to be unregistered, got %d families", got)
+	}
+	if _, ok := pClient.flatKeys["hist"]; ok || len(pClient.flatKeys) != 2 {
+		t.Fatalf("expected only the namespace and subsystem to stay cached, got %v", pClient.flatKeys)
+	}
+
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("hist", h)
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := gathered(); got != 3 {
+		t.Fatalf("expected the metrics to be exported again, got %d families", got)
+	}
+}
+
+func TestFailingHealthcheckExportedOnFirstFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithLazyRegistration()
+	check := metrics.NewHealthcheck(func(h metrics.Healthcheck) {
+		h.Unhealthy(errors.New("down"))
+	})
+	check.Check()
+	metricsRegistry.Register("db", check)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_db" || families[0].GetMetric()[0].GetGauge().GetValue() != 0 {
+		t.Fatalf("expected the failing check at 0 after the first flush, got %v", families)
+	}
+}
+
+// liveRegisterer counts the collectors currently registered with it.
+type liveRegisterer struct {
+	*prometheus.Registry
+	live int
+}
+
+func (r *liveRegisterer) Register(c prometheus.Collector) error {
+	err := r.Registry.Register(c)
+	if err == nil {
+		r.live++
+	}
+	return err
+}
+
+func (r *liveRegisterer) Unregister(c prometheus.Collector) bool {
+	ok := r.Registry.Unregister(c)
+	if ok {
+		r.live--
+	}
+	return ok
+}
+
+func TestChurningNamesUnregisterCollectors(t *testing.T) {
+	prometheusRegistry := &liveRegisterer{Registry: prometheus.NewRegistry()}
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	for ii := 0; ii < 100; ii++ {
+		name := fmt.Sprintf("timer%d", ii)
+		metricsRegistry.Register(name, metrics.NewTimer())
+		pClient.UpdatePrometheusMetricsOnce()
+		metricsRegistry.Unregister(name)
+		pClient.UpdatePrometheusMetricsOnce()
+	}
+
+	if prometheusRegistry.live != 0 || len(pClient.customMetrics) != 0 {
+		t.Fatalf("expected the collectors of removed timers to be unregistered, %d are still registered", prometheusRegistry.live)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHealthcheckErrorInfo()
+	failing := true
+	metricsRegistry.Register("db", metrics.NewHealthcheck(func(h metrics.Healthcheck) {
+		if failing {
+			h.Unhealthy(errors.New("connection refused:\n\ttimeout"))
+			return
+		}
+		h.Healthy()
+	}))
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	names := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		names[family.GetName()] = family
+	}
+	if got := names["test_subsys_db"].GetMetric()[0].GetGauge().GetValue(); got != 0 {
+		t.Fatalf("expected the failing check at 0, got %v", got)
+	}
+	info, ok := names["test_subsys_db_healthcheck_info"]
+	if !ok {
+		t.Fatalf("healthcheck_info was not exported: %v", families)
+	}
+	if label := info.GetMetric()[0].GetLabel()[0]; label.GetName() != "error" || label.GetValue() != "connection refused: timeout" {
+		t.Fatalf("unexpected error label %v", label)
+	}
+
+	failing = false
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ = prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Fatalf("expected only the passing check at 1, got %v", families)
+	}
+}
+
+func TestEWMASuffix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	ewma := metrics.NewEWMA1()
+	metricsRegistry := extraMetricsRegistry{metrics.NewRegistry(), map[string]interface{}{"ewma": ewma}}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithEWMASuffix("_per_second")
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_ewma_per_second" {
+		t.Fatalf("expected test_subsys_ewma_per_second, got %v", families)
+	}
+}
+
+// resettingTimer is a ResettingTimer as found in go-metrics forks: taking a
+// snapshot resets it.
+type resettingTimer struct {
+	values []int64
+}
+
+func (t *resettingTimer) Update(d time.Duration) { t.values = append(t.values, int64(d)) }
+func (t *resettingTimer) Values() []int64        { return t.values }
+func (t *resettingTimer) Snapshot() *resettingTimer {
+	snapshot := &resettingTimer{t.values}
+	t.values = nil
+	return snapshot
+}
+
+func (t *resettingTimer) Percentiles(ps []float64) []int64 {
+	sorted := append([]int64(nil), t.values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	result := make([]int64, len(ps))
+	for ii, p := range ps {
+		if len(sorted) > 0 {
+			result[ii] = sorted[int(p*float64(len(sorted)-1))]
+		}
+	}
+	return result
+}
+
+func (t *resettingTimer) Mean() float64 {
+	if len(t.values) == 0 {
+		return 0
+	}
+	var sum int64
+	for _, v := range t.values {
+		sum += v
+	}
+	return float64(sum) / float64(len(t.values))
+}
+
+func TestResettingTimer(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	tm := &resettingTimer{}
+	metricsRegistry := extraMetricsRegistry{metrics.NewRegistry(), map[string]interface{}{"latency": tm}}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerBuckets([]float64{0.5})
+	tm.Update(1 * time.Second)
+	tm.Update(2 * time.Second)
+	tm.Update(6 * time.Second)
+
+	summary := func() (*dto.Summary, float64) {
+		pClient.UpdatePrometheusMetricsOnce()
+		families, _ := prometheusRegistry.Gather()
+		var summary *dto.Summary
+		var mean float64
+		for _, family := range families {
+			switch family.GetName() {
+			case "test_subsys_latency_timer":
+				summary = family.GetMetric()[0].GetSummary()
+			case "test_subsys_latency_mean":
+				mean = family.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		if summary == nil {
+			t.Fatalf("resetting timer was not exported: %v", families)
+		}
+		return summary, mean
+	}
+
+	s, mean := summary()
+	if s.GetSampleCount() != 3 || s.GetQuantile()[0].GetValue() != float64(2*time.Second) || mean != float64(3*time.Second) {
+		t.Fatalf("unexpected resetting timer export %v with mean %v", s, mean)
+	}
+	if s, _ = summary(); s.GetSampleCount() != 0 {
+		t.Fatalf("expected the timer to be reset after the flush, got %v", s)
+	}
+}
+
+// gaugeInfo is the GaugeInfo of newer go-metrics versions.
+type gaugeInfo struct {
+	value infoValue
+}
+
+type infoValue map[string]string
+
+func (g gaugeInfo) Value() infoValue { return g.value }
+
+func TestGaugeInfo(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := extraMetricsRegistry{metrics.NewRegistry(), map[string]interface{}{
+		"build": gaugeInfo{infoValue{"version": "1.2.3", "commit": "abc123"}},
+	}}
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	if len(families) != 1 || families[0].GetName() != "test_subsys_build_info" {
+		t.Fatalf("expected test_subsys_build_info, got %v", families)
+	}
+	metric := families[0].GetMetric()[0]
+	var labels []string
+	for _, label := range metric.GetLabel() {
+		labels = append(labels, label.GetName()+"="+label.GetValue())
+	}
+	if got := strings.Join(labels, ","); got != "commit=abc123,version=1.2.3" || metric.GetGauge().GetValue() != 1 {
+		t.Fatalf("unexpected build info %v", metric)
+	}
+}
+
+func TestRegisterErrorHandler(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	var failed []string
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithRegisterErrorHandler(func(name string, err error) {
+			failed = append(failed, name)
+		})
+	prometheusRegistry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_subsys_gauge",
+		Help: "conflicting help",
+	}))
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if fmt.Sprint(failed) != "[gauge]" {
+		t.Fatalf("expected the handler to be called for gauge, got %v", failed)
+	}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_register_errors_total" {
+			if got := family.GetMetric()[0].GetCounter().GetValue(); got != 1 {
+				t.Fatalf("expected 1 registration error, got %v", got)
+			}
+			return
+		}
+	}
+	t.Fatalf("register_errors_total was not exported: %v", families)
+}
+
+func TestFlushErrorAggregation(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	sinkErr := errors.New("sink unavailable")
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMetricLabels(map[string]prometheus.Labels{"labelled": {"bad-label": "x"}}).
+		WithSink(func([]*dto.MetricFamily) error { return sinkErr })
+	prometheusRegistry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "test_subsys_colliding",
+		Help: "conflicting help",
+	}))
+	metricsRegistry.Register("colliding", metrics.NewGauge())
+	metricsRegistry.Register("labelled", metrics.NewGauge())
+	metricsRegistry.Register("healthy", metrics.NewGauge())
+
+	err := pClient.UpdatePrometheusMetricsOnce()
+
+	flushErr, ok := err.(*FlushError)
+	if !ok {
+		t.Fatalf("expected a FlushError, got %v", err)
+	}
+	var names []string
+	for _, err := range flushErr.Errors {
+		if metricErr, ok := err.(*MetricError); ok {
+			names = append(names, metricErr.Name)
+		}
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[colliding labelled]" {
+		t.Fatalf("expected errors for colliding and labelled, got %v", flushErr)
+	}
+	if flushErr.Errors[len(flushErr.Errors)-1] != sinkErr {
+		t.Fatalf("expected the sink error last, got %v", flushErr)
+	}
+}
+
+func TestHelpProvider(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithHelpProvider(func(name string) string {
+			if name == "queue_depth" {
+				return "Number of jobs waiting to be processed."
+			}
+			return ""
+		})
+	metricsRegistry.Register("queue_depth", metrics.NewGauge())
+	metricsRegistry.Register("workers", metrics.NewGauge())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	expected := map[string]string{
+		"test_subsys_queue_depth": "Number of jobs waiting to be processed.",
+		"test_subsys_workers":     "workers",
+	}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetHelp() != expected[family.GetName()] {
+			t.Fatalf("%s: expected help %q, got %q", family.GetName(), expected[family.GetName()], family.GetHelp())
+		}
+	}
+}
+
+func TestSelfTelemetry(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithSelfTelemetry().
+		WithSelfHistogramBuckets([]float64{0.001, 1}).
+		WithMetricLabels(map[string]prometheus.Labels{"broken": {"bad-label": "x"}})
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Register("broken", metrics.NewGauge())
+
+	before := time.Now()
+	pClient.UpdatePrometheusMetricsOnce()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	names := make(map[string]*dto.Metric)
+	for _, family := range families {
+		names[family.GetName()] = family.GetMetric()[0]
+	}
+	if got := names["test_subsys_last_flush_timestamp_seconds"].GetGauge().GetValue(); got < float64(before.Unix()) {
+		t.Fatalf("expected a last flush after %v, got %v", before, got)
+	}
+	histogram := names["test_subsys_flush_duration_seconds"].GetHistogram()
+	if histogram.GetSampleCount() != 2 || len(histogram.GetBucket()) != 2 || histogram.GetBucket()[1].GetUpperBound() != 1 {
+		t.Fatalf("unexpected flush duration histogram %v", histogram)
+	}
+	if got := names["test_subsys_metrics_translated_total"].GetCounter().GetValue(); got != 4 {
+		t.Fatalf("expected 4 metrics translated, got %v", got)
+	}
+	if got := names["test_subsys_translation_errors_total"].GetCounter().GetValue(); got != 2 {
+		t.Fatalf("expected 2 translation errors, got %v", got)
+	}
+}
+
+func TestPushGateway(t *testing.T) {
+	var paths []string
+	var bodies []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithPushGateway(gateway.URL, "batch", map[string]string{"instance": "worker-1"})
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	if err := pClient.UpdatePrometheusMetricsOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(paths) != "[PUT /metrics/job/batch/instance/worker-1]" {
+		t.Fatalf("unexpected pushes %v", paths)
+	}
+	if !strings.Contains(bodies[0], "test_subsys_gauge") {
+		t.Fatalf("expected the gauge to be pushed")
+	}
+}
+
+func TestPushToGatewayHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer gateway.Close()
+	defer close(release)
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := pClient.PushToGateway(ctx, gateway.URL, "batch", nil)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("push took %v after the context was done", elapsed)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	server := httptest.NewServer(pClient.Handler())
+	defer server.Close()
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Get("gauge").(metrics.Gauge).Update(7)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !strings.Contains(string(body), "test_subsys_gauge 7") {
+		t.Fatalf("expected the gauge to be served on scrape, got %s", body)
+	}
+}
+
+func TestMultipleRegistries(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	appRegistry := metrics.NewRegistry()
+	libRegistry := metrics.NewRegistry()
+	appRegistry.Register("requests", metrics.NewCounter())
+	libRegistry.Register("requests", metrics.NewGauge())
+	pClient := NewPrometheusProvider(appRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithRegistry(libRegistry, "lib.")
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if fmt.Sprint(names) != "[test_subsys_lib_requests test_subsys_requests]" {
+		t.Fatalf("expected metrics from both registries, got %v", names)
+	}
+	if err := pClient.UpdateMetricOnce("lib.requests"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryNamespaceAndLabels(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	appRegistry := metrics.NewRegistry()
+	saramaRegistry := metrics.NewRegistry()
+	redisRegistry := metrics.NewRegistry()
+	appRegistry.Register("requests", metrics.NewCounter())
+	saramaRegistry.Register("requests", metrics.NewCounter())
+	redisRegistry.Register("pool.size", metrics.NewGauge())
+	pClient := NewPrometheusProvider(appRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithRegistry(saramaRegistry, "sarama.", RegistryNamespace("kafka", "client")).
+		WithRegistry(redisRegistry, "", RegistryLabels(prometheus.Labels{"source": "redis"}))
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var series []string
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			series = append(series, family.GetName()+fmt.Sprint(labels))
+		}
+	}
+	expected := "[kafka_client_sarama_requests[] test_subsys_pool_size[source=redis] test_subsys_requests[]]"
+	if fmt.Sprint(series) != expected {
+		t.Fatalf("got %v, expected %s", series, expected)
+	}
+}
+
+func TestConcurrentFlushAndGather(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	h := metrics.NewHistogram(metrics.NewUniformSample(10))
+	metricsRegistry.Register("hist", h)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	done := make(chan struct{})
+	for ii := 0; ii < 4; ii++ {
+		go func(ii int) {
+			defer func() { done <- struct{}{} }()
+			for jj := 0; jj < 50; jj++ {
+				h.Update(int64(jj))
+				switch ii % 3 {
+				case 0:
+					pClient.UpdatePrometheusMetricsOnce()
+				case 1:
+					pClient.UpdateMetricOnce("hist")
+				default:
+					prometheusRegistry.Gather()
+				}
+			}
+		}(ii)
+	}
+	for ii := 0; ii < 4; ii++ {
+		<-done
+	}
+}
+
+func TestMeterRates(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithMeterRates()
+	metricsRegistry.Register("requests", metrics.NewMeter())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if fmt.Sprint(names) != "[test_subsys_requests test_subsys_requests_rate15m test_subsys_requests_rate5m test_subsys_requests_total]" {
+		t.Fatalf("expected the 5 and 15 minute rates, got %v", names)
+	}
+}
+
+func TestMeterCount(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	m := metrics.NewMeter()
+	metricsRegistry.Register("requests", m)
+	m.Mark(5)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_requests_total" {
+			if family.GetType() != dto.MetricType_COUNTER || family.GetMetric()[0].GetCounter().GetValue() != 5 {
+				t.Fatalf("expected a counter with value 5, got %v", family)
+			}
+			return
+		}
+	}
+	t.Fatalf("meter count was not exported: %v", families)
+}
+
+func TestMeterCountNameClash(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		register func(metrics.Registry)
+	}{
+		{"meter named like its counter", func(r metrics.Registry) {
+			r.Register("requests_total", metrics.NewMeter())
+		}},
+		{"counter named like a meter's counter", func(r metrics.Registry) {
+			r.Register("requests_total", metrics.NewCounter())
+			r.Register("requests", metrics.NewMeter())
+		}},
+	} {
+		prometheusRegistry := prometheus.NewRegistry()
+		metricsRegistry := metrics.NewRegistry()
+		var clashes []string
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+			WithRegisterErrorHandler(func(name string, err error) {
+				clashes = append(clashes, name)
+			})
+		tc.register(metricsRegistry)
+
+		if err := pClient.UpdatePrometheusMetricsOnce(); err == nil || len(clashes) != 1 {
+			t.Fatalf("%s: expected the clash to be reported on registration, got %v and %v", tc.name, err, clashes)
+		}
+		if _, err := prometheusRegistry.Gather(); err != nil {
+			t.Fatalf("%s: expected the registry to stay gatherable, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestStdDev(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithStdDev()
+	h := metrics.NewHistogram(metrics.NewUniformSample(10))
+	h.Update(1)
+	h.Update(3)
+	metricsRegistry.Register("size", h)
+	tm := metrics.NewTimer()
+	tm.Update(1 * time.Millisecond)
+	tm.Update(3 * time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	values := map[string]float64{}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetType() == dto.MetricType_GAUGE {
+			values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		"test_subsys_size_stddev":    1,
+		"test_subsys_size_variance":  1,
+		"test_subsys_latency_stddev": float64(time.Millisecond),
+	}
+	for name, want := range expected {
+		if got, ok := values[name]; !ok || math.Abs(got-want) > 1e-6*want {
+			t.Fatalf("expected %s to be %v, got %v (exported: %v)", name, want, got, ok)
+		}
+	}
+}
+
+func TestCountSum(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCountSum()
+	h := metrics.NewHistogram(metrics.NewUniformSample(10))
+	h.Update(1)
+	h.Update(3)
+	metricsRegistry.Register("size", h)
+	tm := metrics.NewTimer()
+	tm.Update(1 * time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	values := map[string]float64{}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetType() == dto.MetricType_GAUGE {
+			values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		"test_subsys_size_count":    2,
+		"test_subsys_size_sum":      4,
+		"test_subsys_latency_count": 1,
+		"test_subsys_latency_sum":   float64(time.Millisecond),
+	}
+	for name, want := range expected {
+		if got, ok := values[name]; !ok || got != want {
+			t.Fatalf("expected %s to be %v, got %v (exported: %v)", name, want, got, ok)
+		}
+	}
+}
+
+func TestTimerRates(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimerRates(TimerRate1, TimerRate15)
+	metricsRegistry.Register("latency", metrics.NewTimer())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, family := range families {
+		if strings.Contains(family.GetName(), "rate") || family.GetName() == "test_subsys_latency" {
+			names = append(names, family.GetName())
+		}
+	}
+	if fmt.Sprint(names) != "[test_subsys_latency_rate15m test_subsys_latency_rate1m]" {
+		t.Fatalf("expected only the selected rates, got %v", names)
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProviderWithOptions(metricsRegistry,
+		WithNamespace("test"),
+		WithRegisterer(prometheusRegistry),
+		WithPercentiles([]float64{0.5, 0.9}),
+	).WithMetricBuckets("override", []float64{0.99})
+	for _, name := range []string{"size", "latency", "override"} {
+		if name == "latency" {
+			metricsRegistry.Register(name, metrics.NewTimer())
+			continue
+		}
+		metricsRegistry.Register(name, metrics.NewHistogram(metrics.NewUniformSample(10)))
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	bounds := map[string]int{}
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetType() == dto.MetricType_HISTOGRAM {
+			bounds[family.GetName()] = len(family.GetMetric()[0].GetHistogram().GetBucket())
+		}
+	}
+	expected := "map[test_latency_timer:2 test_override_histogram:1 test_size_histogram:2]"
+	if fmt.Sprint(bounds) != expected {
+		t.Fatalf("got %v, expected %s", bounds, expected)
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithExemplars(func(name string) []prometheus.Exemplar {
+			if name != "size" {
+				return nil
+			}
+			return []prometheus.Exemplar{{Value: 3, Labels: prometheus.Labels{"trace_id": "abc"}}}
+		})
+	h := metrics.NewHistogram(metrics.NewUniformSample(10))
+	h.Update(3)
+	metricsRegistry.Register("size", h)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() != "test_subsys_size_histogram" {
+			continue
+		}
+		for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+			if exemplar := bucket.GetExemplar(); exemplar != nil {
+				if exemplar.GetValue() != 3 || exemplar.GetLabel()[0].GetValue() != "abc" {
+					t.Fatalf("unexpected exemplar %v", exemplar)
+				}
+				return
+			}
+		}
+	}
+	t.Fatalf("exemplar was not exported: %v", families)
+}
+
+func TestCounterCreatedTimestamp(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithCountersAsCounters()
+	requests := metrics.NewCounter()
+	metricsRegistry.Register("requests", requests)
+	created := func() time.Time {
+		families, _ := prometheusRegistry.Gather()
+		for _, family := range families {
+			if family.GetName() == "test_subsys_requests_total" {
+				return family.GetMetric()[0].GetCounter().GetCreatedTimestamp().AsTime()
+			}
+		}
+		t.Fatalf("requests_total was not exported: %v", families)
+		return time.Time{}
+	}
+
+	requests.Inc(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	first := created()
+	if first.IsZero() || time.Since(first) > time.Minute {
+		t.Fatalf("unexpected created timestamp %v", first)
+	}
+	time.Sleep(10 * time.Millisecond)
+	requests.Inc(1)
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := created(); !got.Equal(first) {
+		t.Fatalf("created timestamp moved without a reset: %v, then %v", first, got)
+	}
+	requests.Clear()
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := created(); !got.After(first) {
+		t.Fatalf("expected the reset to restart the created timestamp, got %v after %v", got, first)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithTimestamps()
+	metricsRegistry.Register("size", metrics.NewHistogram(metrics.NewUniformSample(10)))
+
+	before := time.Now()
+	pClient.UpdatePrometheusMetricsOnce()
+	after := time.Now()
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_size_histogram" {
+			ts := time.UnixMilli(family.GetMetric()[0].GetTimestampMs())
+			if ts.Before(before.Truncate(time.Millisecond)) || ts.After(after) {
+				t.Fatalf("expected the flush time, got %v", ts)
+			}
+			return
+		}
+	}
+	t.Fatalf("histogram was not exported: %v", families)
+}
+
+func TestStopFlushesOneLastTime(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, time.Hour)
+	g := metrics.NewGauge()
+	metricsRegistry.Register("gauge", g)
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	g.Update(42)
+	pClient.Stop()
+	<-done
+
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		if family.GetName() == "test_subsys_gauge" && family.GetMetric()[0].GetGauge().GetValue() == 42 {
+			return
+		}
+	}
+	t.Fatalf("expected the final flush to export the gauge, got %v", families)
+}
+
+func TestUpdatePrometheusMetricsRunsOnce(t *testing.T) {
+	pClient := NewPrometheusProvider(metrics.NewRegistry(), "test", "subsys", prometheus.NewRegistry(), time.Hour)
+	if pClient.IsRunning() {
+		t.Fatal("expected the loop not to be running before it is started")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(done)
+	}()
+	for !pClient.IsRunning() {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan struct{})
+	go func() {
+		pClient.UpdatePrometheusMetrics()
+		close(second)
+	}()
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("second UpdatePrometheusMetrics did not return while the first was running")
+	}
+
+	pClient.Stop()
+	<-done
+	if pClient.IsRunning() {
+		t.Fatal("expected the loop to have stopped")
+	}
+}
+
+// snapshotCountingTimer counts how often it, or any snapshot of it, is
+// snapshotted.
+type snapshotCountingTimer struct {
+	metrics.Timer
+	snapshots *int
+}
+
+func (t snapshotCountingTimer) Snapshot() metrics.Timer {
+	*t.snapshots++
+	return snapshotCountingTimer{t.Timer.Snapshot(), t.snapshots}
+}
+
+func TestTimerSnapshottedOncePerFlush(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	snapshots := 0
+	tm := snapshotCountingTimer{metrics.NewTimer(), &snapshots}
+	tm.Update(time.Millisecond)
+	metricsRegistry.Register("latency", tm)
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if snapshots != 1 {
+		t.Fatalf("expected 1 snapshot per flush, got %d", snapshots)
+	}
+}
+
+func TestDescsCachedAcrossFlushes(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second)
+	metricsRegistry.Register("latency", metrics.NewTimer())
+	desc := func() *prometheus.Desc {
+		return pClient.customMetrics[pClient.createKey("latency")].metric.Desc()
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+	first := desc()
+	pClient.UpdatePrometheusMetricsOnce()
+
+	if desc() != first {
+		t.Fatal("expected the histogram descriptor to be reused across flushes")
+	}
+	metricsRegistry.Unregister("latency")
+	pClient.UpdatePrometheusMetricsOnce()
+	if _, ok := pClient.descs["latency"]; ok {
+		t.Fatal("expected the descriptors of a removed metric to be dropped")
+	}
+}
+
+func TestSteadyStateFlushAllocations(t *testing.T) {
+	for _, labels := range []prometheus.Labels{nil, {"env": "prod", "region": "eu"}} {
+		metricsRegistry := metrics.NewRegistry()
+		for ii := 0; ii < 100; ii++ {
+			metricsRegistry.Register(fmt.Sprintf("service.requests-%d", ii), metrics.NewGauge())
+		}
+		pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+			WithConstLabels(labels)
+		pClient.UpdatePrometheusMetricsOnce()
+
+		allocs := testing.AllocsPerRun(10, func() { pClient.UpdatePrometheusMetricsOnce() })
+
+		// go-metrics copies the registry on every Each, which is out of our
+		// hands; anything per metric on top of that is a regression.
+		if allocs > 20 {
+			t.Fatalf("expected a steady-state flush with labels %v not to allocate per metric, got %v allocations", labels, allocs)
+		}
+	}
+}
+
+func TestDeltaCounters(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithDeltaCounters()
+	requests := metrics.NewCounter()
+	metricsRegistry.Register("requests", requests)
+	values := func() map[string]float64 {
+		values := map[string]float64{}
+		families, _ := prometheusRegistry.Gather()
+		for _, family := range families {
+			if family.GetType() == dto.MetricType_COUNTER {
+				values[family.GetName()] = family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		return values
+	}
+
+	requests.Inc(5)
+	pClient.UpdatePrometheusMetricsOnce()
+	requests.Inc(2)
+	pClient.UpdatePrometheusMetricsOnce()
+	if got := values()["test_subsys_requests_total"]; got != 7 {
+		t.Fatalf("expected requests_total 7, got %v", got)
+	}
+
+	// the application clears its counter, then counts 3 more
+	requests.Clear()
+	requests.Inc(3)
+	pClient.UpdatePrometheusMetricsOnce()
+	got := values()
+	if got["test_subsys_requests_total"] != 10 {
+		t.Fatalf("expected requests_total to stay monotonic at 10, got %v", got["test_subsys_requests_total"])
+	}
+	if got["test_subsys_counter_resets_total"] != 1 {
+		t.Fatalf("expected 1 counter reset, got %v", got["test_subsys_counter_resets_total"])
+	}
+}
+
+func TestLabelRules(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheusRegistry, 1*time.Second).
+		WithNameParser(LabelRules("queue.<queue>.depth", "db.<shard>.pool.<state>"))
+	for name, val := range map[string]int64{
+		"queue.orders.depth":  3,
+		"queue.emails.depth":  1,
+		"db.eu1.pool.idle":    4,
+		"queue.orders.oldest": 9,
+	} {
+		g := metrics.NewGauge()
+		g.Update(val)
+		metricsRegistry.Register(name, g)
+	}
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	var series []string
+	families, _ := prometheusRegistry.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			series = append(series, fmt.Sprintf("%s{%s} %v", family.GetName(), strings.Join(labels, ","), metric.GetGauge().GetValue()))
+		}
+	}
+	expected := "[test_subsys_db_pool{shard=eu1,state=idle} 4 " +
+		"test_subsys_queue_depth{queue=emails} 1 test_subsys_queue_depth{queue=orders} 3 " +
+		"test_subsys_queue_orders_oldest{} 9]"
+	if fmt.Sprint(series) != expected {
+		t.Fatalf("got %v, expected %s", series, expected)
+	}
+}
+
+func TestTrimPrefix(t *testing.T) {
+	prometheusRegistry := prometheus.NewRegistry()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "myapp", "", prometheusRegistry, 1*time.Second).
+		WithTrimPrefix("myapp.")
+	metricsRegistry.Register("myapp.requests", metrics.NewGauge())
+	metricsRegistry.Register("other.requests", metrics.NewGauge())
+
+	pClient.UpdatePrometheusMetricsOnce()
+
+	families, _ := prometheusRegistry.Gather()
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if fmt.Sprint(names) != "[myapp_other_requests myapp_requests]" {
+		t.Fatalf("expected the myapp. prefix to be trimmed, got %v", names)
+	}
+}
@@ -0,0 +1,218 @@
+package prometheusmetrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// remoteWriteBackoff is the delay before the first retry of a failed
+// remote-write request; it doubles with every further retry.
+var remoteWriteBackoff = 100 * time.Millisecond
+
+// remoteWriteLabel is a label of a remote-write series.
+type remoteWriteLabel struct {
+	name, value string
+}
+
+// remoteWriteSeries is a single sample of a remote-write series.
+type remoteWriteSeries struct {
+	labels    []remoteWriteLabel
+	value     float64
+	timestamp int64
+}
+
+// WithRemoteWrite sends the metrics to the Prometheus remote-write endpoint
+// at url on every flush, in requests of at most batchSize series. Requests
+// that fail with a network error or a 5xx or 429 response are retried up to
+// retries times. Each flush is given at most FlushInterval. It replaces any
+// WithSink.
+func (c *PrometheusConfig) WithRemoteWrite(url string, batchSize int, retries int) *PrometheusConfig {
+	c.sink = func(families []*dto.MetricFamily) error {
+		ctx, cancel := context.WithTimeout(context.Background(), c.FlushInterval)
+		defer cancel()
+		return remoteWrite(ctx, url, families, batchSize, retries)
+	}
+	return c
+}
+
+// RemoteWrite flushes the go-metrics registry and sends the metrics to the
+// Prometheus remote-write endpoint at url, like WithRemoteWrite does on every
+// flush. Sending is abandoned when ctx is done.
+func (c *PrometheusConfig) RemoteWrite(ctx context.Context, url string, batchSize int, retries int) error {
+	if err := c.UpdatePrometheusMetricsOnce(); err != nil {
+		c.logf("prometheusmetrics: flush failed: %v", err)
+	}
+	gatherer, ok := c.promRegistry.(prometheus.Gatherer)
+	if !ok {
+		return errors.New("prometheusmetrics: remote write requires a prometheus registry that implements prometheus.Gatherer")
+	}
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	return remoteWrite(ctx, url, families, batchSize, retries)
+}
+
+// remoteWrite sends families to url in batches of batchSize series.
+func remoteWrite(ctx context.Context, url string, families []*dto.MetricFamily, batchSize int, retries int) error {
+	series := remoteWriteSeriesOf(families, time.Now())
+	if batchSize <= 0 {
+		batchSize = len(series)
+	}
+	for start := 0; start < len(series); start += batchSize {
+		end := start + batchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		body := snappy.Encode(nil, encodeWriteRequest(series[start:end]))
+		if err := sendWriteRequest(ctx, url, body, retries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendWriteRequest posts the compressed write request body to url, retrying
+// recoverable failures up to retries times.
+func sendWriteRequest(ctx context.Context, url string, body []byte, retries int) error {
+	backoff := remoteWriteBackoff
+	for attempt := 0; ; attempt++ {
+		recoverable, err := postWriteRequest(ctx, url, body)
+		if err == nil || !recoverable || attempt >= retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// postWriteRequest posts the compressed write request body to url once. It
+// reports whether a failure is worth retrying.
+func postWriteRequest(ctx context.Context, url string, body []byte) (recoverable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("prometheusmetrics: remote write to %s failed: %s: %s", url, resp.Status, bytes.TrimSpace(msg))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// remoteWriteSeriesOf flattens families into remote-write series, splitting
+// summaries and histograms into their component series. Metrics without a
+// timestamp are given now.
+func remoteWriteSeriesOf(families []*dto.MetricFamily, now time.Time) []remoteWriteSeries {
+	var series []remoteWriteSeries
+	for _, family := range families {
+		name := family.GetName()
+		for _, metric := range family.GetMetric() {
+			timestamp := now.UnixNano() / int64(time.Millisecond)
+			if metric.TimestampMs != nil {
+				timestamp = metric.GetTimestampMs()
+			}
+			add := func(name string, value float64, extra ...remoteWriteLabel) {
+				labels := []remoteWriteLabel{{"__name__", name}}
+				for _, label := range metric.GetLabel() {
+					labels = append(labels, remoteWriteLabel{label.GetName(), label.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				series = append(series, remoteWriteSeries{labels, value, timestamp})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, metric.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, metric.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, metric.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				summary := metric.GetSummary()
+				for _, q := range summary.GetQuantile() {
+					add(name, q.GetValue(), remoteWriteLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add(name+"_sum", summary.GetSampleSum())
+				add(name+"_count", float64(summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				histogram := metric.GetHistogram()
+				infSeen := false
+				for _, bucket := range histogram.GetBucket() {
+					infSeen = infSeen || math.IsInf(bucket.GetUpperBound(), +1)
+					add(name+"_bucket", float64(bucket.GetCumulativeCount()), remoteWriteLabel{"le", formatFloat(bucket.GetUpperBound())})
+				}
+				if !infSeen {
+					add(name+"_bucket", float64(histogram.GetSampleCount()), remoteWriteLabel{"le", "+Inf"})
+				}
+				add(name+"_sum", histogram.GetSampleSum())
+				add(name+"_count", float64(histogram.GetSampleCount()))
+			}
+		}
+	}
+	return series
+}
+
+// formatFloat formats a quantile or bucket bound the way Prometheus does.
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes series as a remote-write WriteRequest protobuf.
+func encodeWriteRequest(series []remoteWriteSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, label := range s.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label.name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
@@ -0,0 +1,199 @@
+package prometheusmetrics
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcrowley/go-metrics"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// decodeWriteRequest decodes a snappy-compressed WriteRequest into one
+// "name{labels} value" string per series.
+func decodeWriteRequest(t *testing.T, body []byte) []string {
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var series []string
+	each := func(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) int) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("bad tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			n = fn(num, typ, b)
+			if n < 0 {
+				t.Fatalf("bad field: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	each(raw, func(_ protowire.Number, _ protowire.Type, b []byte) int {
+		ts, n := protowire.ConsumeBytes(b)
+		var name string
+		var labels []string
+		var value float64
+		each(ts, func(num protowire.Number, _ protowire.Type, b []byte) int {
+			msg, n := protowire.ConsumeBytes(b)
+			fields := map[protowire.Number]string{}
+			each(msg, func(field protowire.Number, typ protowire.Type, b []byte) int {
+				if typ == protowire.Fixed64Type {
+					v, n := protowire.ConsumeFixed64(b)
+					value = math.Float64frombits(v)
+					return n
+				}
+				if typ == protowire.VarintType {
+					_, n := protowire.ConsumeVarint(b)
+					return n
+				}
+				s, n := protowire.ConsumeString(b)
+				fields[field] = s
+				return n
+			})
+			if num == 1 && fields[1] == "__name__" {
+				name = fields[2]
+			} else if num == 1 {
+				labels = append(labels, fields[1]+"="+fields[2])
+			}
+			return n
+		})
+		series = append(series, fmt.Sprintf("%s{%s} %g", name, strings.Join(labels, ","), value))
+		return n
+	})
+	return series
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	var series []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		series = append(series, decodeWriteRequest(t, body)...)
+	}))
+	defer receiver.Close()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithRemoteWrite(receiver.URL, 2, 0)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+	metricsRegistry.Get("gauge").(metrics.Gauge).Update(3)
+	metricsRegistry.Register("counter", metrics.NewCounter())
+	metricsRegistry.Get("counter").(metrics.Counter).Inc(2)
+	metricsRegistry.Register("other", metrics.NewGauge())
+
+	if err := pClient.UpdatePrometheusMetricsOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(series)
+	expected := "[test_subsys_counter{} 2 test_subsys_gauge{} 3 test_subsys_other{} 0]"
+	if fmt.Sprint(series) != expected {
+		t.Fatalf("got %v, expected %s", series, expected)
+	}
+	if requests != 2 {
+		t.Fatalf("expected 3 series to be sent in 2 batches, got %d requests", requests)
+	}
+}
+
+func TestRemoteWriteHistogramSeries(t *testing.T) {
+	var series []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		series = append(series, decodeWriteRequest(t, body)...)
+	}))
+	defer receiver.Close()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second).
+		WithSummaryExport([]float64{0.5})
+	h := metrics.NewHistogram(metrics.NewUniformSample(10))
+	metricsRegistry.Register("hist", h)
+	h.Update(4)
+
+	if err := pClient.RemoteWrite(context.Background(), receiver.URL, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"test_subsys_hist_histogram{quantile=0.5} 4",
+		"test_subsys_hist_histogram_sum{} 4",
+		"test_subsys_hist_histogram_count{} 1",
+	} {
+		found := false
+		for _, s := range series {
+			found = found || s == want
+		}
+		if !found {
+			t.Fatalf("expected %q in %v", want, series)
+		}
+	}
+}
+
+func TestRemoteWriteRetries(t *testing.T) {
+	defer func(backoff time.Duration) { remoteWriteBackoff = backoff }(remoteWriteBackoff)
+	remoteWriteBackoff = time.Millisecond
+	var requests int
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	if err := pClient.RemoteWrite(context.Background(), receiver.URL, 100, 2); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected the request to be retried once, got %d requests", requests)
+	}
+
+	failures = 10
+	if err := pClient.RemoteWrite(context.Background(), receiver.URL, 100, 2); err == nil {
+		t.Fatal("expected an error once retries are exhausted")
+	}
+}
+
+func TestRemoteWriteHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+	defer close(release)
+	metricsRegistry := metrics.NewRegistry()
+	pClient := NewPrometheusProvider(metricsRegistry, "test", "subsys", prometheus.NewRegistry(), 1*time.Second)
+	metricsRegistry.Register("gauge", metrics.NewGauge())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := pClient.RemoteWrite(ctx, receiver.URL, 100, 5); err == nil {
+		t.Fatal("expected the cancelled write to fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("remote write ignored the context deadline")
+	}
+}